@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go/build"
+	"strings"
+	"time"
+)
+
+// batch is a single run of a batch generator on behalf of a number of
+// directives, in possibly many packages, that have the same arguments
+type batch struct {
+	args []string
+	gen  *Generator
+	pkgs []string
+	dirs map[string][]directive
+
+	// dir is the directory of the config in force for the packages (see
+	// Config.root)
+	dir string
+}
+
+// generateBatches runs the directives in pkgs for the batch generators of
+// phase (see Generator.Batch), one run per distinct set of arguments. pkgs
+// are listed in GG_PACKAGES in the order given
+func generateBatches(phase, it string, pkgs []string) {
+	var batches []*batch
+	byArgs := make(map[string]*batch)
+
+	for _, p := range pkgs {
+		dirs, err := pkgDirectives(p)
+		if err != nil {
+			fatalf("could not read directives in %v: %v", p, err)
+		}
+
+		for _, d := range dirs {
+			if _, ok := pkgConfig(p).cmds(phase)[d.cmd()]; !ok || !d.generator().Batch {
+				continue
+			}
+
+			// a batch runs from the directory of the config, so directives
+			// in packages with different configs cannot share a batch
+			k := pkgConfig(p).dir + "\x00" + strings.Join(d.args, "\x00")
+
+			b, ok := byArgs[k]
+			if !ok {
+				b = &batch{args: d.args, gen: d.generator(), dir: pkgConfig(p).root(), dirs: make(map[string][]directive)}
+				byArgs[k] = b
+				batches = append(batches, b)
+			}
+
+			if _, ok := b.dirs[p]; !ok {
+				b.pkgs = append(b.pkgs, p)
+			}
+
+			b.dirs[p] = append(b.dirs[p], d)
+		}
+	}
+
+	// batches for generators that must run after others (see
+	// Generator.After) run after the batches for those generators
+	idx, _ := stableOrder(len(batches), func(i, j int) bool {
+		c := pkgConfig(batches[j].pkgs[0])
+
+		return c.runsAfter(batches[j].gen.cmd(), batches[i].gen.cmd())
+	})
+
+	for _, i := range idx {
+		b := batches[i]
+		out := new(bytes.Buffer)
+
+		err := b.run(phase, it, out)
+
+		if out.Len() > 0 && !*fJSON {
+			fmt.Print(out.String())
+		}
+
+		if err != nil {
+			fatalf("%v", err)
+		}
+	}
+}
+
+func (b *batch) run(phase, it string, out *bytes.Buffer) error {
+	g := b.gen
+
+	env := []string{
+		"GOARCH=" + build.Default.GOARCH,
+		"GOOS=" + build.Default.GOOS,
+		"GOROOT=" + build.Default.GOROOT,
+		"DOLLAR=" + "$",
+	}
+	env = append(env, ggEnv(phase, it, b.dir, b.pkgs)...)
+	env = append(env, g.Env...)
+
+	before := make(map[string]map[string]string)
+	beforeMod := make(map[string]map[string]time.Time)
+
+	for _, p := range b.pkgs {
+		var err error
+
+		pd := pkgInfo[p].Dir
+
+		if before[p], err = dirHashes(pd); err != nil {
+			return fmt.Errorf("%v: could not hash directory: %v", p, err)
+		}
+		if beforeMod[p], err = dirModTimes(pd); err != nil {
+			return fmt.Errorf("%v: could not read directory: %v", p, err)
+		}
+	}
+
+	if *fExecute {
+		fmt.Fprintf(out, "%v # batch: %v\n", strings.Join(b.args, " "), strings.Join(b.pkgs, " "))
+	}
+
+	emit(event{Action: evDirectiveStart, Packages: b.pkgs, Phase: phase, Args: b.args})
+
+	// as for a directive (see runDirective), we snapshot the packages so
+	// as to undo the changes of a generator killed for exceeding a timeout,
+	// and otherwise report those of a generator stopped by an interrupt.
+	// Batches run before the other directives of the phase, so no package
+	// is being generated concurrently
+	var snap *snapshot
+
+	if g.timeout > 0 || *fTimeout > 0 {
+		var err error
+
+		snap, err = takeSnapshot(pkgDirs(b.pkgs))
+		if err != nil {
+			return fmt.Errorf("batch %v for %v: %v", strings.Join(b.args, " "), strings.Join(b.pkgs, " "), err)
+		}
+	}
+
+	t := time.Now()
+	gout := new(bytes.Buffer)
+
+	err := runGenerator(g, b.dir, b.args, env, gout)
+
+	times.since(timeGenerator, g.cmd(), t)
+
+	ev := event{
+		Action:   evDirectiveEnd,
+		Packages: b.pkgs,
+		Phase:    phase,
+		Args:     b.args,
+		Elapsed:  time.Since(t).Seconds(),
+		ExitCode: intPtr(exitCode(err)),
+		Cached:   boolPtr(false),
+		Output:   gout.String(),
+	}
+	if err != nil {
+		ev.Error = err.Error()
+	}
+	emit(ev)
+
+	out.Write(gout.Bytes())
+
+	if err != nil {
+		var ke *killedError
+		if errors.As(err, &ke) {
+			var left string
+
+			if snap != nil {
+				left = undo(snap)
+			} else {
+				dirs := make(map[string]map[string]string)
+				for _, p := range b.pkgs {
+					dirs[pkgInfo[p].Dir] = before[p]
+				}
+
+				left = leftChanges(dirs)
+			}
+
+			return fmt.Errorf("batch %v for %v: %w%v", strings.Join(b.args, " "), strings.Join(b.pkgs, " "), err, left)
+		}
+
+		return fmt.Errorf("batch %v for %v: %w", strings.Join(b.args, " "), strings.Join(b.pkgs, " "), err)
+	}
+
+	for _, p := range b.pkgs {
+		pd := pkgInfo[p].Dir
+
+		after, err := dirHashes(pd)
+		if err != nil {
+			return fmt.Errorf("%v: could not hash directory: %v", p, err)
+		}
+
+		afterMod, err := dirModTimes(pd)
+		if err != nil {
+			return fmt.Errorf("%v: could not read directory: %v", p, err)
+		}
+
+		if err := checkOutputs(g, before[p], after, beforeMod[p], afterMod); err != nil {
+			return fmt.Errorf("%v: %v", p, err)
+		}
+
+		m := loadManifest(pd)
+
+		for _, d := range b.dirs[p] {
+			m.record(d, before[p], after, beforeMod[p], afterMod)
+		}
+
+		if *fCheck {
+			continue
+		}
+
+		if err := m.save(); err != nil {
+			return fmt.Errorf("could not save manifest for %v: %v", p, err)
+		}
+	}
+
+	return nil
+}
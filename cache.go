@@ -0,0 +1,251 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	cacheDirName    = "gg"
+	pkgCacheDirName = "pkgs"
+)
+
+// pkgCacheEntry is the record gg persists for a package after a successful run.
+// Hash is the package hash (see computePkgHash) as it stood at the end of that
+// run, and hence includes the generated files produced during the run
+type pkgCacheEntry struct {
+	ImportPath string
+	Dir        string
+	Hash       string
+
+	// Config is a hash of the generator configuration in force for the package;
+	// a change in configuration invalidates the entry
+	Config string
+
+	// Generators are the fingerprints of the generators used by the
+	// package (see generatorFingerprints); a change in any one of them (for
+	// example a new build of the generator) invalidates the entry
+	Generators map[string]string
+
+	// Deps is a hash of the state of the packages on which the package
+	// depends (see depsState), whether or not they were matched by the
+	// patterns of the run, so that a change to a dependency invalidates the
+	// entry even if the run that made the change did not record it
+	Deps string
+}
+
+func ggCacheDir() string {
+	d, err := os.UserCacheDir()
+	if err != nil {
+		fatalf("could not determine user cache directory: %v", err)
+	}
+
+	return filepath.Join(d, cacheDirName)
+}
+
+// pkgCacheFile returns the path of the cache entry for the package in dir. We
+// key on the directory rather than the import path because the same import
+// path can resolve to different directories (think multiple GOPATH entries)
+func pkgCacheFile(dir string) string {
+	return filepath.Join(ggCacheDir(), pkgCacheDirName, fmt.Sprintf("%x", sha1.Sum([]byte(dir))))
+}
+
+// hash returns a hash of the generator configuration c
+func (c *Config) hash() string {
+	h := sha1.New()
+
+	typed := append([]string(nil), c.Typed...)
+	untyped := append([]string(nil), c.Untyped...)
+
+	sort.Strings(typed)
+	sort.Strings(untyped)
+
+	for _, v := range typed {
+		fmt.Fprintf(h, "typed %v\n", v)
+	}
+
+	for _, v := range untyped {
+		fmt.Fprintf(h, "untyped %v\n", v)
+	}
+
+	// the phases, and their order, determine which generators see the
+	// output of which
+	for _, ph := range c.phases {
+		fmt.Fprintf(h, "phase %v %v\n", ph.Name, ph.Compiled)
+	}
+
+	// the remaining settings of each generator affect what it generates
+	cmds := make([]string, 0, len(c.gens))
+	for cmd := range c.gens {
+		cmds = append(cmds, cmd)
+	}
+
+	sort.Strings(cmds)
+
+	for _, cmd := range cmds {
+		b, err := json.Marshal(c.gens[cmd])
+		if err != nil {
+			fatalf("could not marshal config for generator %v: %v", cmd, err)
+		}
+
+		fmt.Fprintf(h, "generator %s\n", b)
+	}
+
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+func loadPkgCache(pName string) (pkgCacheEntry, bool) {
+	var e pkgCacheEntry
+
+	pkg := pkgInfo[pName]
+
+	b, err := ioutil.ReadFile(pkgCacheFile(pkg.Dir))
+	if err != nil {
+		return e, false
+	}
+
+	if err := json.Unmarshal(b, &e); err != nil {
+		vvlogf("ignoring corrupt cache entry for %v: %v", pName, err)
+		return e, false
+	}
+
+	return e, e.ImportPath == pkg.ImportPath && e.Dir == pkg.Dir
+}
+
+// cacheStale returns the subset of pkgs whose current hash, the generators
+// they use, or the state of their dependencies differ from those recorded in
+// the cache at the end of the last successful run. pkgs should include
+// packages without directives, so that changes to them are seen by their
+// dependents (see generate). pkgHash must have already been computed for
+// each package, and extPkgs must be current
+func cacheStale(pkgs []string) []string {
+	var stale []string
+
+	for _, p := range pkgs {
+		e, ok := loadPkgCache(p)
+
+		if !ok || e.Config != pkgConfig(p).hash() || e.Hash != pkgInfo[p].pkgHash {
+			stale = append(stale, p)
+			continue
+		}
+
+		if e.Deps != depsState(pkgInfo[p]) {
+			vvlogf("%v is stale; dependencies changed", p)
+			stale = append(stale, p)
+			continue
+		}
+
+		if gs := changedGenerators(e.Generators, generatorFingerprints(p)); len(gs) > 0 {
+			vvlogf("%v is stale; generators changed: %v", p, strings.Join(gs, ", "))
+			stale = append(stale, p)
+			continue
+		}
+
+		vvlogf("%v is up to date", p)
+	}
+
+	return stale
+}
+
+// savePkgCache records the current state of pkgs in the cache. The hashes of
+// all packages are first brought up to date, because generators may have
+// written to packages that contain no directives (see Generator.WriteOutside)
+func savePkgCache(pkgs []string) {
+	dir := filepath.Join(ggCacheDir(), pkgCacheDirName)
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		fatalf("could not create cache directory %v: %v", dir, err)
+	}
+
+	for _, pkg := range pkgInfo {
+		computePkgHash(pkg)
+	}
+
+	for _, p := range pkgs {
+		pkg := pkgInfo[p]
+
+		e := pkgCacheEntry{
+			ImportPath: pkg.ImportPath,
+			Dir:        pkg.Dir,
+			Hash:       pkg.pkgHash,
+			Config:     pkgConfig(p).hash(),
+			Generators: generatorFingerprints(p),
+			Deps:       depsState(pkg),
+		}
+
+		b, err := json.Marshal(e)
+		if err != nil {
+			fatalf("could not marshal cache entry for %v: %v", p, err)
+		}
+
+		if err := writeFileAtomic(pkgCacheFile(pkg.Dir), b); err != nil {
+			fatalf("could not write cache entry for %v: %v", p, err)
+		}
+	}
+}
+
+// depsState returns a hash of the package hashes (see computePkgHash) of the
+// non-standard packages on which pkg depends. extPkgs must be current; the
+// hashes of packages outside the run are computed as required
+func depsState(pkg *Package) string {
+	deps := keySlice(allDeps(pkg))
+	sort.Strings(deps)
+
+	h := sha1.New()
+
+	for _, d := range deps {
+		dp, ok := pkgInfo[d]
+		if !ok {
+			dp = extPkgs[d]
+		}
+
+		if dp == nil {
+			fmt.Fprintf(h, "pkg %v unknown\n", d)
+			continue
+		}
+
+		if dp.Standard {
+			continue
+		}
+
+		if dp.pkgHash == "" {
+			computePkgHash(dp)
+		}
+
+		fmt.Fprintf(h, "pkg %v %v\n", d, dp.pkgHash)
+	}
+
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// writeFileAtomic writes b to fn via a temporary file in the same directory so
+// that concurrent gg runs never observe a partially written file. It is safe
+// to call from any goroutine
+func writeFileAtomic(fn string, b []byte) error {
+	tf, err := ioutil.TempFile(filepath.Dir(fn), filepath.Base(fn)+".tmp")
+	if err != nil {
+		return fmt.Errorf("could not create temp file for %v: %v", fn, err)
+	}
+
+	_, err = tf.Write(b)
+	if cerr := tf.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tf.Name())
+		return fmt.Errorf("could not write %v: %v", tf.Name(), err)
+	}
+
+	if err := os.Rename(tf.Name(), fn); err != nil {
+		os.Remove(tf.Name())
+		return fmt.Errorf("could not rename %v to %v: %v", tf.Name(), fn, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// writePkg creates package name in dir/name with the single file p.go
+// containing src, registering it in pkgInfo with the given deps
+func writePkg(t *testing.T, dir, name, src string, deps ...string) *Package {
+	t.Helper()
+
+	pd := filepath.Join(dir, name)
+
+	if err := os.MkdirAll(pd, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(pd, "p.go"), []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Package{
+		ImportPath: "ex/" + name,
+		Dir:        pd,
+		Name:       name,
+		GoFiles:    []string{"p.go"},
+		Deps:       deps,
+	}
+
+	pkgInfo[p.ImportPath] = p
+
+	return p
+}
+
+// setupCache isolates the gg cache, config and package state of a test
+func setupCache(t *testing.T) string {
+	t.Helper()
+
+	dir := t.TempDir()
+
+	t.Setenv("XDG_CACHE_HOME", filepath.Join(dir, "cache"))
+
+	wd = dir
+	configCeiling = dir
+	t.Cleanup(func() { configCeiling = "" })
+	pkgInfo = make(map[string]*Package)
+	extPkgs = make(map[string]*Package)
+
+	loadConfig()
+
+	return dir
+}
+
+func hashAll() {
+	for _, p := range pkgInfo {
+		computePkgHash(p)
+	}
+}
+
+func TestCacheStaleDependency(t *testing.T) {
+	tests := []struct {
+		name string
+
+		// saved are the packages recorded by the first run; a package
+		// with directives whose generation failed is not recorded
+		saved []string
+
+		// change is the package changed after the first run
+		change string
+
+		want []string
+	}{
+		{
+			name:   "unchanged",
+			saved:  []string{"ex/b", "ex/a"},
+			change: "",
+			want:   nil,
+		},
+		{
+			name:   "dependency without directives changed",
+			saved:  []string{"ex/b", "ex/a"},
+			change: "b",
+			want:   []string{"ex/a", "ex/b"},
+		},
+		{
+			name:   "dependency changed by a run in which the dependent failed",
+			saved:  []string{"ex/b"},
+			change: "",
+			want:   []string{"ex/a"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := setupCache(t)
+
+			writePkg(t, dir, "b", "package b\n\nconst B = 1\n")
+			writePkg(t, dir, "a", "package a\n\nimport \"ex/b\"\n\nconst A = b.B\n", "ex/b")
+
+			hashAll()
+
+			// the first run sees a at a previous state of b
+			if len(tt.saved) == 1 {
+				savePkgCache([]string{"ex/a", "ex/b"})
+				writePkg(t, dir, "b", "package b\n\nconst B = 2\n")
+			}
+
+			savePkgCache(tt.saved)
+
+			if tt.change != "" {
+				writePkg(t, dir, tt.change, "package b\n\nconst B = 3\n")
+			}
+
+			hashAll()
+
+			got := cacheStale([]string{"ex/a", "ex/b"})
+			sort.Strings(got)
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("cacheStale() = %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
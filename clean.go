@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"myitcv.io/gogenerate"
+)
+
+// clean implements gg clean [-n] [-gen cmds] [packages]. It removes the files
+// generated by configured generators in the packages matched by args: files
+// named as generated by one of those generators (see
+// gogenerate.FileIsGenerated) and files recorded in the manifest as owned by
+// a directive that runs one of them. Files from generators not in the config
+// in force for a package are left alone
+func clean(args []string) {
+	loadConfig()
+
+	pkgs := loadPkgs(args)
+
+	var gens []string
+
+	if *fCleanGen != "" {
+		gens = splitCmdList(*fCleanGen)
+
+		known := make(map[string]struct{})
+		for _, p := range pkgs {
+			for cmd := range pkgConfig(p).gens {
+				known[cmd] = struct{}{}
+			}
+		}
+
+		for _, g := range gens {
+			if _, ok := known[g]; !ok {
+				fatalf("generator %q is not a configured generator", g)
+			}
+		}
+	}
+
+	for _, p := range pkgs {
+		cmds := make(map[string]struct{})
+
+		for cmd := range pkgConfig(p).gens {
+			cmds[cmd] = struct{}{}
+		}
+
+		if gens != nil {
+			sel := make(map[string]struct{})
+
+			for _, g := range gens {
+				if _, ok := cmds[g]; ok {
+					sel[g] = struct{}{}
+				}
+			}
+
+			cmds = sel
+		}
+
+		cleanPkg(p, cmds, *fDryRun)
+	}
+}
+
+func cleanPkg(pName string, cmds map[string]struct{}, dryRun bool) {
+	pkg := pkgInfo[pName]
+
+	files := readDirFiles(pkg.Dir)
+
+	remove := make(map[string]struct{})
+
+	for f := range files {
+		if cmd, ok := gogenerate.FileIsGenerated(f); ok {
+			if _, ok := cmds[cmd]; ok {
+				remove[f] = struct{}{}
+			}
+		}
+	}
+
+	m := loadManifest(pkg.Dir)
+	hashes := m.hashes()
+
+	for _, e := range m.Directives {
+		if len(e.Args) == 0 {
+			continue
+		}
+
+		if _, ok := cmds[filepath.Base(e.Args[0])]; !ok {
+			continue
+		}
+
+		for _, o := range e.Outputs {
+			f := filepath.Join(pkg.Dir, o)
+
+			if _, ok := files[f]; !ok {
+				continue
+			}
+
+			// files named as generated are removed regardless; others only
+			// if the user has not edited them (see cmdList)
+			if _, ok := remove[f]; ok {
+				continue
+			}
+
+			if h := hashes[o]; h == "" || !unedited(f, h) {
+				log.Printf("not removing %v: it may have been edited since it was generated", relPath(f))
+				continue
+			}
+
+			remove[f] = struct{}{}
+		}
+
+		if !dryRun {
+			e.Outputs = nil
+			e.Hashes = nil
+		}
+	}
+
+	rs := keySlice(remove)
+	sort.Strings(rs)
+
+	for _, f := range rs {
+		if dryRun {
+			fmt.Printf("rm %v\n", relPath(f))
+			continue
+		}
+
+		vvlogf("removing %v", f)
+		emit(event{Action: evRemove, Package: pName, File: f})
+
+		if err := os.Remove(f); err != nil {
+			fatalf("could not remove %v: %v", f, err)
+		}
+	}
+
+	if !dryRun {
+		if err := m.save(); err != nil {
+			fatalf("could not save manifest for %v: %v", pName, err)
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// command is a gg subcommand. gg invoked without a subcommand is equivalent
+// to gg run, hence gg [flags] [packages] continues to work as it always has
+type command struct {
+	name  string
+	usage string
+	short string
+	long  string
+
+	flags *flag.FlagSet
+
+	// run is called with the arguments that remain after flag parsing
+	run func(args []string)
+}
+
+var runCmd = &command{
+	name:  "run",
+	usage: "[-n] [-watch] [flags] [packages]",
+	short: "run the generators in packages until they converge",
+	long: `
+Run runs the go generate directives in the packages named by the import
+paths, one phase at a time in the order given by the Phases of the config
+files (by default untyped generators, then typed generators), repeating until
+the packages no longer change. Packages are compiled before a phase marked
+Compiled, which then runs only in those that compile. Packages that are
+unchanged since they were last generated are skipped.
+
+The -n flag prints the plan (stale packages, directives to run, files to
+remove) without running it.
+
+The -watch flag watches the packages for changes, regenerating as required.
+
+For compatibility, -l is equivalent to gg list and -check to gg check.
+`,
+	flags: flag.NewFlagSet("run", flag.ExitOnError),
+	run:   run,
+}
+
+var listCmd = &command{
+	name:  "list",
+	usage: "[flags] [packages]",
+	short: "list the go generate directives in packages",
+	long: `
+List prints the go generate directives in the packages named by the import
+paths, one per line, as file:line: args.
+`,
+	flags: flag.NewFlagSet("list", flag.ExitOnError),
+	run:   list,
+}
+
+var checkCmd = &command{
+	name:  "check",
+	usage: "[flags] [packages]",
+	short: "fail if generation would change any files",
+	long: `
+Check runs the generators in the packages named by the import paths, as gg
+run does, and fails if doing so changes any files. The tree is left as it
+was found.
+`,
+	flags: flag.NewFlagSet("check", flag.ExitOnError),
+	run:   check,
+}
+
+var cleanCmd = &command{
+	name:  "clean",
+	usage: "[-n] [-gen cmds] [flags] [packages]",
+	short: "remove generated files",
+	long: `
+Clean removes the files generated by configured generators in the packages
+named by the import paths: files named as generated by one of those
+generators and files recorded as owned by a directive that runs one of them.
+Files from generators not in the config are left alone.
+`,
+	flags: flag.NewFlagSet("clean", flag.ExitOnError),
+	run:   clean,
+}
+
+var graphCmd = &command{
+	name:  "graph",
+	usage: "[-format text|dot|json] [flags] [packages]",
+	short: "print the graph of packages, directives, generators and files",
+	long: `
+Graph prints the generation graph of the packages named by the import paths
+that contain directives. Its nodes are packages, directives, generators
+(labelled with their phase) and generated files. Its edges run from each
+package to its directives, from each directive to the generator it runs and
+to any packages named by its outpkg: flags, from each generator to the files
+it generated, and from each package to the packages with directives on which
+it (transitively) depends; a change in the latter causes the former to be
+regenerated.
+
+The -format flag selects the output format: text (the default) prints one
+edge per line as "from kind to", dot prints a Graphviz digraph, and json
+prints an object with Nodes and Edges.
+`,
+	flags: flag.NewFlagSet("graph", flag.ExitOnError),
+	run:   graph,
+}
+
+var envCmd = &command{
+	name:  "env",
+	usage: "[flags] [var ...]",
+	short: "print gg environment information",
+	long: `
+Env prints the config in force for a package in the current directory, and
+the directories gg uses. GGCONFIG lists the config files merged to form the
+config, outermost first. By default env prints the information as
+NAME="value" lines. If one or more variable names are given as arguments,
+env prints the value of each named variable on its own line.
+`,
+	flags: flag.NewFlagSet("env", flag.ExitOnError),
+	run:   env,
+}
+
+var configCmd = &command{
+	name:  "config",
+	usage: "check [flags] [packages]",
+	short: "check the config and print the effective config",
+	long: `
+Config check validates the config files in force for the packages named by
+the import paths, or for the current directory if none are given, reporting
+the position of each error. Config files must not contain unknown fields
+(field names are case-sensitive), duplicate or conflicting entries, or
+different generators with the same command name.
+
+For each distinct config, config check then prints the effective config: the
+result of merging the config files, as a config file in its own right.
+`,
+	flags: flag.NewFlagSet("config", flag.ExitOnError),
+	run:   configCommand,
+}
+
+var commands = []*command{
+	runCmd,
+	listCmd,
+	checkCmd,
+	cleanCmd,
+	graphCmd,
+	envCmd,
+	configCmd,
+}
+
+func init() {
+	addLoadFlags(runCmd.flags)
+	addGenFlags(runCmd.flags)
+	runCmd.flags.BoolVar(fDryRun, "n", false, "print the plan (stale packages, directives to run, files to remove) without running it")
+	runCmd.flags.BoolVar(fWatch, "watch", false, "watch packages for changes, regenerating as required")
+	runCmd.flags.BoolVar(fList, "l", false, "list go generate directive commands in packages (see gg list)")
+	runCmd.flags.BoolVar(fCheck, "check", false, "fail if generation would change any files, leaving the tree unchanged (see gg check)")
+
+	addLoadFlags(listCmd.flags)
+
+	addLoadFlags(checkCmd.flags)
+	addGenFlags(checkCmd.flags)
+
+	addLoadFlags(cleanCmd.flags)
+	cleanCmd.flags.BoolVar(fDryRun, "n", false, "print the files that would be removed without removing them")
+	cleanCmd.flags.StringVar(fCleanGen, "gen", "", "a comma-separated list of generators whose files should be removed (default all configured generators)")
+
+	addLoadFlags(graphCmd.flags)
+	graphCmd.flags.StringVar(fGraphFormat, "format", "text", "the output format: text, dot or json")
+
+	addLoadFlags(configCmd.flags)
+
+	envCmd.flags.StringVar(fUntyped, "untyped", "", "a list of untyped generators to run")
+	envCmd.flags.StringVar(fTyped, "typed", "", "a list of typed generators to run")
+	envCmd.flags.StringVar(fCompiler, "compiler", "", "the backend used to compile packages (overrides the config): "+strings.Join(compilerNames(), ", "))
+
+	for _, c := range commands {
+		c := c
+		c.flags.Usage = func() {
+			c.printUsage(os.Stderr)
+		}
+	}
+}
+
+// lookupCommand returns the command named name, or nil
+func lookupCommand(name string) *command {
+	for _, c := range commands {
+		if c.name == name {
+			return c
+		}
+	}
+
+	return nil
+}
+
+// parseCommand returns the command selected by args (the command line less
+// the program name) along with the arguments to be parsed by its flags. It
+// returns a nil command if help was requested
+func parseCommand(args []string) (*command, []string) {
+	if len(args) > 0 {
+		switch args[0] {
+		case "help", "-h", "-help", "--help":
+			help(args[1:])
+			return nil, nil
+		}
+
+		if c := lookupCommand(args[0]); c != nil {
+			return c, args[1:]
+		}
+	}
+
+	return runCmd, args
+}
+
+func (c *command) printUsage(w *os.File) {
+	fmt.Fprintf(w, "usage: gg %v %v\n%v\n", c.name, c.usage, c.long)
+
+	var hasFlags bool
+	c.flags.VisitAll(func(*flag.Flag) { hasFlags = true })
+
+	if hasFlags {
+		fmt.Fprintf(w, "Flags:\n")
+		c.flags.SetOutput(w)
+		c.flags.PrintDefaults()
+	}
+}
+
+func printUsage(w *os.File) {
+	fmt.Fprintf(w, "gg is a wrapper for go generate.\n\nUsage:\n\n\tgg <command> [flags] [packages]\n\nThe commands are:\n\n")
+
+	for _, c := range commands {
+		fmt.Fprintf(w, "\t%-8v%v\n", c.name, c.short)
+	}
+
+	fmt.Fprintf(w, "\ngg [flags] [packages] is equivalent to gg run [flags] [packages].\n\n")
+	fmt.Fprintf(w, "Use \"gg help <command>\" for more information about a command.\n")
+}
+
+// help implements gg help [command]
+func help(args []string) {
+	switch len(args) {
+	case 0:
+		printUsage(os.Stdout)
+	case 1:
+		c := lookupCommand(args[0])
+		if c == nil {
+			fmt.Fprintf(os.Stderr, "gg help %v: unknown command\n", args[0])
+			os.Exit(2)
+		}
+
+		c.printUsage(os.Stdout)
+	default:
+		fmt.Fprintf(os.Stderr, "usage: gg help [command]\n")
+		os.Exit(2)
+	}
+}
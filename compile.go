@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A compiler compiles (and installs) packages between the untyped and typed
+// phases, so that typed generators see up to date type information
+type compiler interface {
+	// install installs pkgs and returns the subsets of pkgs that succeeded
+	// and failed respectively
+	install(pkgs []string) ([]string, []string)
+}
+
+const defaultCompiler = "go"
+
+var compilers = map[string]compiler{
+	"go":  goCompiler{},
+	"gai": gaiCompiler{},
+}
+
+func compilerNames() []string {
+	res := make([]string, 0, len(compilers))
+	for k := range compilers {
+		res = append(res, k)
+	}
+
+	sort.Strings(res)
+
+	return res
+}
+
+// goInstall installs pkgs, returning the subsets that succeeded and failed
+// respectively. Each package is installed by the compiler of its config;
+// packages are otherwise installed together
+func goInstall(pkgs []string) ([]string, []string) {
+	byCompiler := make(map[string][]string)
+
+	for _, p := range pkgs {
+		c := pkgConfig(p).Compiler
+		byCompiler[c] = append(byCompiler[c], p)
+	}
+
+	var suc, fail []string
+
+	for _, c := range compilerNames() {
+		if len(byCompiler[c]) == 0 {
+			continue
+		}
+
+		t := time.Now()
+
+		s, f := compilers[c].install(byCompiler[c])
+
+		times.since(timeInstall, c, t)
+
+		suc = append(suc, s...)
+		fail = append(fail, f...)
+	}
+
+	return suc, fail
+}
+
+// goCompiler uses go list -export to compile packages, which reports compile
+// errors per package (including errors in dependencies) in its JSON output.
+// Packages that succeed are then installed with go install
+type goCompiler struct{}
+
+func (goCompiler) install(pkgs []string) ([]string, []string) {
+	xlogf("go list -e -export -json %v", strings.Join(pkgs, " "))
+
+	failed := make(map[string]struct{})
+	errs := make(map[string]struct{})
+
+	for _, lp := range goList(append([]string{"-export"}, pkgs...)...) {
+		if lp.Error == nil && len(lp.DepsErrors) == 0 {
+			continue
+		}
+
+		failed[lp.ImportPath] = struct{}{}
+
+		for _, e := range append(lp.DepsErrors, lp.Error) {
+			if e != nil {
+				errs[e.Err] = struct{}{}
+			}
+		}
+	}
+
+	for _, e := range keySlice(errs) {
+		xlog(e)
+	}
+
+	s, f := partition(pkgs, failed)
+
+	if len(s) > 0 {
+		args := append([]string{"install"}, s...)
+
+		xlogf("go %v", strings.Join(args, " "))
+
+		out, err := exec.Command("go", args...).CombinedOutput()
+		if err != nil {
+			fatalf("go install: %v\n%s", err, out)
+		}
+	}
+
+	return s, f
+}
+
+// gaiCompiler uses the external gai command, determining which packages
+// failed from the "# pkg" lines in its output
+type gaiCompiler struct{}
+
+func (gaiCompiler) install(pkgs []string) ([]string, []string) {
+	fmap := make(map[string]struct{})
+
+	xlogf("gai %v", strings.Join(pkgs, " "))
+	vvlogf("gai %v", strings.Join(pkgs, " "))
+
+	out, err := exec.Command("gai", pkgs...).CombinedOutput()
+	if err != nil {
+		sc := bufio.NewScanner(bytes.NewBuffer(out))
+		for sc.Scan() {
+			line := sc.Text()
+
+			if strings.HasPrefix(line, "# ") {
+				parts := strings.Fields(line)
+
+				if len(parts) != 2 {
+					fatalf("could not parse go install output\n%v", string(out))
+				}
+
+				fmap[parts[1]] = struct{}{}
+			}
+		}
+
+		if err := sc.Err(); err != nil {
+			fatalf("could not parse go install output\n%v", string(out))
+		}
+	}
+
+	if len(out) > 0 {
+		xlog(string(out))
+	}
+
+	return partition(pkgs, fmap)
+}
+
+// partition returns the packages in pkgs that are not in failed and those
+// that are, preserving order
+func partition(pkgs []string, failed map[string]struct{}) ([]string, []string) {
+	var f, s []string
+
+	for _, p := range pkgs {
+		if _, ok := failed[p]; ok {
+			f = append(f, p)
+		} else {
+			s = append(s, p)
+		}
+	}
+
+	return s, f
+}
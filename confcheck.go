@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// configSource is the text of a config file, used to report the position
+// of errors within it
+type configSource struct {
+	fn string
+	b  []byte
+
+	// seen counts, by search string, the occurrences consumed by find
+	seen map[string]int
+}
+
+// pos returns a file:line:col position for offset off
+func (s *configSource) pos(off int64) string {
+	if off < 0 || off > int64(len(s.b)) {
+		return s.fn
+	}
+
+	pre := s.b[:off]
+	line := bytes.Count(pre, []byte("\n")) + 1
+	col := int(off) - bytes.LastIndexByte(pre, '\n')
+
+	return fmt.Sprintf("%v:%v:%v", s.fn, line, col)
+}
+
+// find returns the position of the next occurrence of the JSON string str,
+// followed by a colon if key is true, or the position of the file as a whole
+// if there is none. Successive calls for the same string return successive
+// occurrences
+func (s *configSource) find(str string, key bool) string {
+	q, _ := json.Marshal(str)
+
+	re := regexp.QuoteMeta(string(q))
+	if key {
+		re += `\s*:`
+	}
+
+	k := re
+	ms := regexp.MustCompile(re).FindAllIndex(s.b, -1)
+
+	n := s.seen[k]
+	s.seen[k]++
+
+	if n >= len(ms) {
+		if len(ms) == 0 {
+			return s.fn
+		}
+
+		n = len(ms) - 1
+	}
+
+	return s.pos(int64(ms[n][0]))
+}
+
+func (s *configSource) errorf(pos string, format string, args ...interface{}) error {
+	return fmt.Errorf("%v: %v", pos, fmt.Sprintf(format, args...))
+}
+
+// parseConfig decodes and validates the contents b of config file fn. It
+// returns the decoded config (or nil if b cannot be decoded) and any errors,
+// each prefixed with its position in the file
+func parseConfig(fn string, b []byte) (*Config, []error) {
+	s := &configSource{fn: fn, b: b, seen: make(map[string]int)}
+
+	if errs := s.checkKeys(); len(errs) > 0 {
+		return nil, errs
+	}
+
+	c := new(Config)
+
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+
+	if err := dec.Decode(c); err != nil {
+		return nil, []error{s.decodeError(err, dec)}
+	}
+
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, []error{s.errorf(s.pos(dec.InputOffset()), "unexpected data after config")}
+	}
+
+	return c, s.validate(c)
+}
+
+func (s *configSource) decodeError(err error, dec *json.Decoder) error {
+	var se *json.SyntaxError
+	var te *json.UnmarshalTypeError
+
+	switch {
+	case errors.As(err, &se):
+		return s.errorf(s.pos(se.Offset), "%v", se)
+	case errors.As(err, &te):
+		return s.errorf(s.pos(te.Offset), "%v has type %v; want %v", te.Field, te.Value, te.Type)
+	case err == io.EOF:
+		return s.errorf(s.fn, "empty config")
+	case err == io.ErrUnexpectedEOF:
+		return s.errorf(s.pos(int64(len(s.b))), "unexpected end of config")
+	}
+
+	return s.errorf(s.pos(dec.InputOffset()), "%v", err)
+}
+
+// checkKeys checks the keys of the config object and of each Generators
+// entry against the fields of Config and Generator respectively. Unlike
+// encoding/json, which matches keys case-insensitively, we require an exact
+// match: "typed" is an error rather than an alias for "Typed". Values that
+// are not objects are left for the decoder to report
+func (s *configSource) checkKeys() []error {
+	var top map[string]json.RawMessage
+
+	if err := json.Unmarshal(s.b, &top); err != nil {
+		return nil
+	}
+
+	var errs []error
+
+	check := func(m map[string]json.RawMessage, t reflect.Type) {
+		want := make(map[string]bool)
+		for i := 0; i < t.NumField(); i++ {
+			if f := t.Field(i); f.PkgPath == "" {
+				want[f.Name] = true
+			}
+		}
+
+		for _, k := range sortedRawKeys(m) {
+			if !want[k] {
+				errs = append(errs, s.errorf(s.find(k, true), "unknown field %q in %v", k, t.Name()))
+			}
+		}
+	}
+
+	check(top, reflect.TypeOf(Config{}))
+
+	var gens, phases []map[string]json.RawMessage
+
+	if err := json.Unmarshal(top["Generators"], &gens); err == nil {
+		for _, g := range gens {
+			check(g, reflect.TypeOf(Generator{}))
+		}
+	}
+
+	if err := json.Unmarshal(top["Phases"], &phases); err == nil {
+		for _, ph := range phases {
+			check(ph, reflect.TypeOf(Phase{}))
+		}
+	}
+
+	return errs
+}
+
+func sortedRawKeys(m map[string]json.RawMessage) []string {
+	res := make([]string, 0, len(m))
+
+	for k := range m {
+		res = append(res, k)
+	}
+
+	sort.Strings(res)
+
+	return res
+}
+
+// validate reports entries in c that are invalid, duplicated, conflict with
+// one another (for example a generator listed as both typed and untyped) or
+// whose commands collide (different import paths with the same base name,
+// which go generate directives cannot distinguish). A Generators entry may
+// give the settings for a generator that is also listed, in a phase or in
+// Typed or Untyped, provided that it gives the same phase. Entries in a config file only override those of outer
+// files, so these checks apply to the file alone; in particular, the phases
+// of generators can only be checked here if the file declares Phases
+func (s *configSource) validate(c *Config) []error {
+	var errs []error
+
+	if c.Compiler != "" {
+		if _, ok := compilers[c.Compiler]; !ok {
+			errs = append(errs, s.errorf(s.find(c.Compiler, false), "unknown compiler %q; must be one of %v", c.Compiler, strings.Join(compilerNames(), ", ")))
+		}
+	}
+
+	var declared map[string]bool
+
+	if len(c.Phases) > 0 {
+		declared = make(map[string]bool)
+	}
+
+	for _, ph := range c.Phases {
+		if ph == nil {
+			errs = append(errs, s.errorf(s.find("Phases", true), "null entry in Phases"))
+			continue
+		}
+
+		// find every name, so that an error is reported at the
+		// occurrence that caused it
+		pos := s.find(ph.Name, false)
+
+		switch {
+		case !validCmd.MatchString(ph.Name):
+			errs = append(errs, s.errorf(pos, "invalid phase name %q", ph.Name))
+		case declared[ph.Name]:
+			errs = append(errs, s.errorf(pos, "phase %v is declared more than once", ph.Name))
+		default:
+			declared[ph.Name] = true
+		}
+	}
+
+	// lists and gens record the phase of each path in the lists (Typed,
+	// Untyped and those of Phases) and in Generators respectively, and paths
+	// the path of each command, as first seen
+	lists := make(map[string]string)
+	gens := make(map[string]string)
+	paths := make(map[string]string)
+
+	add := func(path, phase, where string) {
+		pos := s.find(path, false)
+
+		if path == "" {
+			errs = append(errs, s.errorf(pos, "empty generator in %v", where))
+			return
+		}
+
+		cmd := filepath.Base(path)
+
+		if !validCmd.MatchString(cmd) {
+			errs = append(errs, s.errorf(pos, "%v: invalid go generate cmd %q", path, cmd))
+			return
+		}
+
+		if declared != nil && !declared[phase] {
+			errs = append(errs, s.errorf(pos, "%v: phase %v is not declared in Phases", path, phase))
+			return
+		}
+
+		// a path may have both a list entry and a Generators entry, giving
+		// its settings, provided they agree on its phase
+		same, other := lists, gens
+		if where == "Generators" {
+			same, other = gens, lists
+		}
+
+		if p, ok := same[path]; ok {
+			if p == phase {
+				errs = append(errs, s.errorf(pos, "%v is listed more than once", path))
+			} else {
+				errs = append(errs, s.errorf(pos, "%v is listed as both %v and %v", path, p, phase))
+			}
+			return
+		}
+
+		if p, ok := other[path]; ok && p != phase {
+			errs = append(errs, s.errorf(pos, "%v is listed as both %v and %v", path, p, phase))
+			return
+		}
+
+		if p, ok := paths[cmd]; ok && p != path {
+			errs = append(errs, s.errorf(pos, "%v and %v have the same command name %v", p, path, cmd))
+			return
+		}
+
+		same[path] = phase
+		paths[cmd] = path
+	}
+
+	// find consumes occurrences in file order, so visit the lists in the
+	// order they appear in the file
+	sections := []struct {
+		key string
+		fn  func()
+	}{
+		{"Untyped", func() {
+			for _, v := range c.Untyped {
+				add(v, "untyped", "Untyped")
+			}
+		}},
+		{"Typed", func() {
+			for _, v := range c.Typed {
+				add(v, "typed", "Typed")
+			}
+		}},
+		{"Phases", func() {
+			for _, ph := range c.Phases {
+				if ph == nil {
+					continue
+				}
+
+				for _, v := range ph.Generators {
+					add(v, ph.Name, "phase "+ph.Name)
+				}
+			}
+		}},
+		{"Generators", func() {
+			for _, g := range c.Generators {
+				if g == nil {
+					errs = append(errs, s.errorf(s.find("Generators", true), "null entry in Generators"))
+					continue
+				}
+
+				if err := g.init(); err != nil {
+					errs = append(errs, s.errorf(s.find(g.Path, false), "%v", err))
+					continue
+				}
+
+				add(g.Path, g.Phase, "Generators")
+			}
+		}},
+	}
+
+	sort.SliceStable(sections, func(i, j int) bool {
+		return s.offset(sections[i].key) < s.offset(sections[j].key)
+	})
+
+	for _, v := range sections {
+		v.fn()
+	}
+
+	return errs
+}
+
+// offset returns the offset of the first occurrence of key as an object key,
+// or -1 if there is none
+func (s *configSource) offset(key string) int {
+	q, _ := json.Marshal(key)
+
+	loc := regexp.MustCompile(regexp.QuoteMeta(string(q)) + `\s*:`).FindIndex(s.b)
+	if loc == nil {
+		return -1
+	}
+
+	return loc[0]
+}
+
+// configCommand implements gg config
+func configCommand(args []string) {
+	if len(args) == 0 || args[0] != "check" {
+		fmt.Fprintf(os.Stderr, "usage: gg config check [flags] [packages]\n")
+		os.Exit(2)
+	}
+
+	configCheck(args[1:])
+}
+
+// configCheck implements gg config check. It validates the config files in
+// force for the packages matched by args, or for the working directory if
+// there are none, and prints the effective config for each distinct set of
+// files
+func configCheck(args []string) {
+	loadConfig()
+
+	type use struct {
+		c    *Config
+		pkgs []string
+	}
+
+	var uses []*use
+	byFiles := make(map[string]*use)
+
+	add := func(c *Config, pkg string) {
+		k := strings.Join(c.files, "\x00")
+
+		u, ok := byFiles[k]
+		if !ok {
+			u = &use{c: c}
+			byFiles[k] = u
+			uses = append(uses, u)
+		}
+
+		if pkg != "" {
+			u.pkgs = append(u.pkgs, pkg)
+		}
+	}
+
+	if len(args) == 0 {
+		add(configFor(wd), "")
+	} else {
+		for _, p := range loadPkgs(args) {
+			add(pkgConfig(p), p)
+		}
+	}
+
+	for i, u := range uses {
+		if i > 0 {
+			fmt.Println()
+		}
+
+		fmt.Printf("# config: %v\n", u.c.describe())
+
+		if len(u.pkgs) > 0 {
+			fmt.Printf("# packages: %v\n", strings.Join(u.pkgs, " "))
+		}
+
+		eff := Config{
+			Root:       true,
+			Compiler:   u.c.Compiler,
+			Phases:     u.c.Phases,
+			Generators: u.c.entries,
+		}
+
+		b, err := json.MarshalIndent(eff, "", "\t")
+		if err != nil {
+			fatalf("could not marshal config: %v", err)
+		}
+
+		fmt.Printf("%s\n", b)
+	}
+}
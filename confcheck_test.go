@@ -0,0 +1,146 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want []string
+	}{
+		{
+			name: "valid",
+			src:  `{"Untyped": ["ex/a"], "Typed": ["ex/b"]}`,
+		},
+		{
+			name: "settings for a listed generator",
+			src:  `{"Untyped": ["ex/a"], "Generators": [{"Path": "ex/a", "Phase": "untyped", "Env": ["X=1"]}]}`,
+		},
+		{
+			name: "settings for a listed generator in another phase",
+			src:  `{"Untyped": ["ex/a"], "Generators": [{"Path": "ex/a", "Phase": "typed"}]}`,
+			want: []string{`c.json:1:47: ex/a is listed as both untyped and typed`},
+		},
+		{
+			name: "settings in another phase before the list",
+			src:  `{"Generators": [{"Path": "ex/a", "Phase": "typed"}], "Typed": ["ex/a"], "Untyped": ["ex/a"]}`,
+			want: []string{`c.json:1:85: ex/a is listed as both typed and untyped`},
+		},
+		{
+			name: "Generators entries for the same path",
+			src:  `{"Generators": [{"Path": "ex/a", "Phase": "typed"}, {"Path": "ex/a", "Phase": "typed"}]}`,
+			want: []string{`c.json:1:62: ex/a is listed more than once`},
+		},
+		{
+			name: "empty",
+			src:  ``,
+			want: []string{`c.json: empty config`},
+		},
+		{
+			name: "key with the wrong case",
+			src:  "{\n\t\"typed\": [\"ex/b\"]\n}",
+			want: []string{`c.json:2:2: unknown field "typed" in Config`},
+		},
+		{
+			name: "unknown key in Generators",
+			src:  `{"Generators": [{"Path": "ex/a", "Phase": "untyped", "Bach": true}]}`,
+			want: []string{`c.json:1:54: unknown field "Bach" in Generator`},
+		},
+		{
+			name: "syntax error",
+			src:  "{\n\t\"Untyped\": [\"ex/a\",]\n}",
+			want: []string{`c.json:2:22: invalid character ']' looking for beginning of value`},
+		},
+		{
+			name: "truncated",
+			src:  "{\n\t\"Untyped\": [\"ex/a\"",
+			want: []string{`c.json:2:20: unexpected end of config`},
+		},
+		{
+			name: "wrong type",
+			src:  `{"Root": "yes"}`,
+			want: []string{`c.json:1:15: Root has type string; want bool`},
+		},
+		{
+			name: "trailing data",
+			src:  "{}\n{}",
+			want: []string{`c.json:2:2: unexpected data after config`},
+		},
+		{
+			name: "unknown compiler",
+			src:  `{"Compiler": "gcc"}`,
+			want: []string{`c.json:1:14: unknown compiler "gcc"; must be one of gai, go`},
+		},
+		{
+			name: "invalid command",
+			src:  `{"Untyped": ["ex/my-gen"]}`,
+			want: []string{`c.json:1:14: ex/my-gen: invalid go generate cmd "my-gen"`},
+		},
+		{
+			name: "listed twice",
+			src:  `{"Untyped": ["ex/a", "ex/a"]}`,
+			want: []string{`c.json:1:22: ex/a is listed more than once`},
+		},
+		{
+			name: "listed as typed and then untyped",
+			src:  "{\n\t\"Typed\": [\"ex/a\"],\n\t\"Untyped\": [\"ex/a\"]\n}",
+			want: []string{`c.json:3:14: ex/a is listed as both typed and untyped`},
+		},
+		{
+			name: "same command name",
+			src:  `{"Untyped": ["ex/a/gen", "ex/b/gen"]}`,
+			want: []string{`c.json:1:26: ex/a/gen and ex/b/gen have the same command name gen`},
+		},
+		{
+			name: "invalid timeout",
+			src:  `{"Generators": [{"Path": "ex/a", "Phase": "untyped", "Timeout": "soon"}]}`,
+			want: []string{`c.json:1:26: ex/a: invalid Timeout: time: invalid duration "soon"`},
+		},
+		{
+			name: "phase declared twice",
+			src:  `{"Phases": [{"Name": "gen"}, {"Name": "gen"}]}`,
+			want: []string{`c.json:1:39: phase gen is declared more than once`},
+		},
+		{
+			name: "invalid phase name",
+			src:  `{"Phases": [{"Name": "gen"}, {"Name": "my-phase"}]}`,
+			want: []string{`c.json:1:39: invalid phase name "my-phase"`},
+		},
+		{
+			name: "phase not declared",
+			src:  "{\n\t\"Phases\": [{\"Name\": \"gen\"}],\n\t\"Untyped\": [\"ex/a\"]\n}",
+			want: []string{`c.json:3:14: ex/a: phase untyped is not declared in Phases`},
+		},
+		{
+			name: "generator listed in two phases",
+			src:  `{"Phases": [{"Name": "gen", "Generators": ["ex/a"]}, {"Name": "post", "Generators": ["ex/a"]}]}`,
+			want: []string{`c.json:1:86: ex/a is listed as both gen and post`},
+		},
+		{
+			name: "several errors",
+			src:  "{\n\t\"Untyped\": [\"ex/a\", \"ex/a\"],\n\t\"Generators\": [{\"Path\": \"ex/b\", \"Phase\": \"untyped\", \"Timeout\": \"-\"}]\n}",
+			want: []string{
+				`c.json:2:22: ex/a is listed more than once`,
+				`c.json:3:26: ex/b: invalid Timeout: time: invalid duration "-"`,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, errs := parseConfig("c.json", []byte(tt.src))
+
+			var got []string
+			for _, err := range errs {
+				got = append(got, err.Error())
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseConfig() errors:\n%q\nwant:\n%q", got, tt.want)
+			}
+		})
+	}
+}
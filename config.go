@@ -1,102 +1,519 @@
 package main
 
 import (
-	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 )
 
 const (
 	ConfigFileName = ".ggconfig.json"
 )
 
+// Config is the contents of a config file. The config in force for a package
+// is the result of merging the config files found in its directory and its
+// parent directories (see configFor)
 type Config struct {
-	Typed   []string
-	Untyped []string
+	// Root indicates that the config does not extend those found in parent
+	// directories
+	Root bool `json:",omitempty"`
 
-	// maps of the packages
-	typed   map[string]struct{}
-	untyped map[string]struct{}
+	Typed   []string `json:",omitempty"`
+	Untyped []string `json:",omitempty"`
 
-	// maps of the commands, essentially the bases of the packages
-	typedCmds   map[string]struct{}
-	untypedCmds map[string]struct{}
+	// Compiler is the name of the backend used to compile packages before
+	// phases that require compiled dependencies; see compilers
+	Compiler string `json:",omitempty"`
+
+	// Phases declares the phases of the pipeline, in order, replacing those
+	// of outer config files. If no config file declares any, the phases are
+	// untyped and then typed (see defaultPhases)
+	Phases []*Phase `json:",omitempty"`
+
+	// Generators holds the settings for individual generators. Generators
+	// listed in Typed or Untyped instead take the default settings, except
+	// that they may write outside their package. A generator that appears in
+	// both takes the settings given here
+	Generators []*Generator `json:",omitempty"`
+
+	// entries are the generators of the merged config, one per phase in
+	// which a command runs
+	entries []*Generator
+
+	// phases are the phases of the merged config
+	phases []*Phase
+
+	// phaseCmds maps each phase to the commands, essentially the bases of
+	// the packages, of the generators that run in it
+	phaseCmds map[string]map[string]struct{}
+
+	// after maps each command to the commands it must run after, directly
+	// or indirectly (see Generator.After)
+	after map[string]map[string]struct{}
+
+	// gens maps the command of each generator to its settings
+	gens map[string]*Generator
+
+	// dir is the directory containing the nearest config file, or empty if
+	// the generators were specified via flags or there is no config file
+	dir string
+
+	// files are the config files merged, outermost first
+	files []string
 }
 
-var config Config
+// Generator holds the settings for a generator. In addition to the
+// environment of go generate, gg runs a generator with GG_PHASE, GG_ROOT,
+// GG_PACKAGES and GG_ITERATION set (see ggEnv). A generator must not vary
+// its output by GG_ITERATION: the effect of a directive is cached whatever
+// the iteration, and so may be restored in a later one
+type Generator struct {
+	// Path is the import path of the generator or, where the generator is
+	// to be found on PATH, its command name
+	Path string
+
+	// Phase is the name of the phase in which the generator runs
+	Phase string
+
+	// After lists the command names of generators that, within a package,
+	// must run before it. They must run in the same phase or an earlier one
+	After []string `json:",omitempty"`
+
+	// Env holds additional environment variables, each of the form
+	// key=value, for the generator. They take precedence over those set by
+	// go generate and gg (see ggEnv)
+	Env []string `json:",omitempty"`
+
+	// Timeout is the longest a single run of the generator may take, per
+	// time.ParseDuration. There is no limit if it is empty. The changes made
+	// to the package directory by a run that is killed for exceeding a
+	// timeout (this or -timeout) are undone
+	Timeout string `json:",omitempty"`
+
+	// Outputs holds glob patterns (per filepath.Match) for the names of the
+	// files the generator writes in the package directory. If set, it is
+	// an error for the generator to write any other file there, and the
+	// directive that runs it owns the files it writes that match
+	Outputs []string `json:",omitempty"`
+
+	// Batch indicates that a single run of the generator can process many
+	// packages. Within a phase, gg runs a batch generator once for all the
+	// directives that have the same arguments, before the other directives
+	// in the phase, from the directory containing the config file and with
+	// the import paths of the packages in GG_PACKAGES
+	Batch bool `json:",omitempty"`
+
+	// WriteOutside indicates that the generator may write to packages other
+	// than its own, i.e. that directives which run it may use outpkg: flags
+	WriteOutside bool `json:",omitempty"`
+
+	timeout time.Duration
+
+	// dir is the directory of the config file that declares the generator,
+	// from which it is built (see buildGenerators)
+	dir string
+}
+
+// cmd returns the command name of the generator
+func (g *Generator) cmd() string {
+	return filepath.Base(g.Path)
+}
+
+// isOutput returns whether the file name matches one of g's Outputs
+func (g *Generator) isOutput(name string) bool {
+	for _, o := range g.Outputs {
+		if ok, _ := filepath.Match(o, name); ok {
+			return true
+		}
+	}
+
+	return false
+}
 
 var validCmd = regexp.MustCompile(`^[a-zA-Z0-9]+$`)
 
+var (
+	configLock sync.Mutex
+
+	// configCeiling, if set, is the outermost directory in which config
+	// files are sought (see findConfig). Tests set it so that they do not
+	// see config files outside of their temporary directories
+	configCeiling string
+
+	// configs maps a directory to the config in force there
+	configs map[string]*Config
+
+	// configFiles maps the path of a config file to its decoded contents
+	configFiles map[string]*Config
+
+	// flagConfig is the config specified via -typed and -untyped, if any,
+	// which is in force everywhere
+	flagConfig *Config
+)
+
+// loadConfig prepares for configs to be resolved by configFor, discarding
+// any previously read
 func loadConfig() {
+	configLock.Lock()
+	defer configLock.Unlock()
+
+	configs = make(map[string]*Config)
+	configFiles = make(map[string]*Config)
+	flagConfig = nil
+
 	if *fUntyped != "" || *fTyped != "" {
-		config.Untyped = splitCmdList(*fUntyped)
-		config.Typed = splitCmdList(*fTyped)
-	} else {
-		// TODO maybe instead of using $PWD as the starting point for finding a config file we should start at
-		// the package directory...
+		c := &Config{}
 
-		var err error
+		for _, v := range splitCmdList(*fUntyped) {
+			c.entries = append(c.entries, &Generator{Path: v, Phase: "untyped", WriteOutside: true})
+		}
+		for _, v := range splitCmdList(*fTyped) {
+			c.entries = append(c.entries, &Generator{Path: v, Phase: "typed", WriteOutside: true})
+		}
 
-		wd, err := os.Getwd()
-		if err != nil {
-			log.Fatal(err)
+		c.init()
+
+		flagConfig = c
+	}
+}
+
+// configFor returns the config in force for a package in dir. Starting from
+// dir, we walk up the directory tree collecting config files until we find
+// one with Root set or reach the root of the file system. The files are then
+// merged, outermost first: an inner file extends the generators of the outer
+// files, replacing the entries of any command it lists, and its Compiler and
+// Phases, if set, take precedence. If there are no config files, the config
+// has no generators
+func configFor(dir string) *Config {
+	configLock.Lock()
+	defer configLock.Unlock()
+
+	if flagConfig != nil {
+		return flagConfig
+	}
+
+	if c, ok := configs[dir]; ok {
+		return c
+	}
+
+	var files []string
+
+	for d := dir; ; {
+		fn := findConfig(d)
+		if fn == "" {
+			break
+		}
+
+		files = append([]string{fn}, files...)
+
+		if readConfigFile(fn).Root {
+			break
+		}
+
+		p := filepath.Dir(filepath.Dir(fn))
+		if p == filepath.Dir(fn) {
+			break
 		}
 
-		dir := wd
+		d = p
+	}
+
+	c := &Config{files: files}
 
-		var fi *os.File
+	for _, fn := range files {
+		fc := readConfigFile(fn)
+		fdir := filepath.Dir(fn)
 
-		for {
-			f := filepath.Join(dir, ConfigFileName)
+		// a Generators entry replaces any entry for the same command in
+		// Typed, Untyped or the Generators of a phase in the same file...
+		var gens []*Generator
+		listed := make(map[string]bool)
 
-			fi, err = os.Open(f)
-			if err == nil {
-				break
+		for _, g := range fc.Generators {
+			g := *g
+			g.dir = fdir
+
+			if err := g.init(); err != nil {
+				fatalf("invalid generator in %v: %v", fn, err)
 			}
 
-			p := filepath.Dir(dir)
+			listed[g.cmd()] = true
+			gens = append(gens, &g)
+		}
+
+		var own []*Generator
 
-			if p == dir {
-				break
+		for _, v := range fc.Untyped {
+			if !listed[filepath.Base(v)] {
+				own = append(own, &Generator{Path: v, Phase: "untyped", WriteOutside: true, dir: fdir})
+			}
+		}
+		for _, v := range fc.Typed {
+			if !listed[filepath.Base(v)] {
+				own = append(own, &Generator{Path: v, Phase: "typed", WriteOutside: true, dir: fdir})
 			}
+		}
+		for _, ph := range fc.Phases {
+			for _, v := range ph.Generators {
+				if !listed[filepath.Base(v)] {
+					own = append(own, &Generator{Path: v, Phase: ph.Name, WriteOutside: true, dir: fdir})
+				}
+			}
+		}
 
-			dir = p
+		own = append(own, gens...)
+
+		// ... and the entries of a file replace those for the same commands
+		// in outer files
+		cmds := make(map[string]bool)
+		for _, g := range own {
+			cmds[g.cmd()] = true
 		}
 
-		if fi == nil {
-			log.Fatalf("Could not find %v in %v (or any parent directory)", ConfigFileName, wd)
+		var inherited []*Generator
+		for _, g := range c.entries {
+			if !cmds[g.cmd()] {
+				inherited = append(inherited, g)
+			}
 		}
 
-		j := json.NewDecoder(fi)
-		err = j.Decode(&config)
-		if err != nil {
-			log.Fatalf("Could not decode config file %v:\n%v", fi.Name(), err)
+		c.entries = append(inherited, own...)
+
+		if fc.Compiler != "" {
+			c.Compiler = fc.Compiler
 		}
+
+		if len(fc.Phases) > 0 {
+			c.Phases = nil
+
+			for _, ph := range fc.Phases {
+				c.Phases = append(c.Phases, &Phase{Name: ph.Name, Compiled: ph.Compiled})
+			}
+		}
+
+		c.dir = fdir
 	}
 
-	config.typed = make(map[string]struct{})
-	config.untyped = make(map[string]struct{})
+	c.init()
 
-	config.typedCmds = make(map[string]struct{})
-	config.untypedCmds = make(map[string]struct{})
+	configs[dir] = c
 
-	for _, v := range config.Typed {
-		b := filepath.Base(v)
-		config.typed[v] = struct{}{}
-		config.typedCmds[b] = struct{}{}
+	return c
+}
+
+// readConfigFile returns the decoded contents of the config file fn, which
+// must be valid (see parseConfig)
+func readConfigFile(fn string) *Config {
+	if c, ok := configFiles[fn]; ok {
+		return c
 	}
 
-	for _, v := range config.Untyped {
-		b := filepath.Base(v)
-		config.untyped[v] = struct{}{}
-		config.untypedCmds[b] = struct{}{}
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		fatalf("could not read config file %v: %v", fn, err)
 	}
 
-	config.Typed = keySlice(config.typed)
-	config.Untyped = keySlice(config.untyped)
+	c, errs := parseConfig(fn, b)
+	if len(errs) > 0 {
+		msgs := make([]string, len(errs))
+		for i, e := range errs {
+			msgs[i] = e.Error()
+		}
+
+		fatalf("invalid config file %v:\n%v", fn, strings.Join(msgs, "\n"))
+	}
+
+	configFiles[fn] = c
+
+	return c
+}
+
+// init completes c given its entries
+func (c *Config) init() {
+	if *fCompiler != "" {
+		c.Compiler = *fCompiler
+	}
+
+	if c.Compiler == "" {
+		c.Compiler = defaultCompiler
+	}
+
+	if _, ok := compilers[c.Compiler]; !ok {
+		fatalf("unknown compiler %q; must be one of %v", c.Compiler, strings.Join(compilerNames(), ", "))
+	}
+
+	c.phases = c.Phases
+	if len(c.phases) == 0 {
+		c.phases = defaultPhases
+	}
+
+	c.phaseCmds = make(map[string]map[string]struct{})
+	for _, ph := range c.phases {
+		c.phaseCmds[ph.Name] = make(map[string]struct{})
+	}
+
+	c.gens = make(map[string]*Generator)
+
+	typed := make(map[string]struct{})
+	untyped := make(map[string]struct{})
+
+	for _, g := range c.entries {
+		b := g.cmd()
+
+		cmds, ok := c.phaseCmds[g.Phase]
+		if !ok {
+			fatalf("%v runs in phase %v, which is not one of %v (config: %v)", g.Path, g.Phase, phaseNames(c.phases), c.describe())
+		}
+
+		cmds[b] = struct{}{}
+
+		switch g.Phase {
+		case "typed":
+			typed[g.Path] = struct{}{}
+		case "untyped":
+			untyped[g.Path] = struct{}{}
+		}
+
+		c.gens[b] = g
+	}
+
+	c.Typed = keySlice(typed)
+	c.Untyped = keySlice(untyped)
+
+	sort.Strings(c.Typed)
+	sort.Strings(c.Untyped)
+
+	c.initOrder()
+}
+
+// cmds returns the commands of the generators that run in phase
+func (c *Config) cmds(phase string) map[string]struct{} {
+	return c.phaseCmds[phase]
+}
+
+// phase returns the phase in which cmd runs, or the empty string if cmd is
+// not a configured generator
+func (c *Config) phase(cmd string) string {
+	if g, ok := c.gens[cmd]; ok {
+		return g.Phase
+	}
+
+	return ""
+}
+
+// generator returns the settings for the generator with command cmd. A
+// command not in the config takes the default settings
+func (c *Config) generator(cmd string) *Generator {
+	if g, ok := c.gens[cmd]; ok {
+		return g
+	}
+
+	return &Generator{Path: cmd}
+}
+
+// root returns the directory holding the nearest config file, or the working
+// directory if there is none
+func (c *Config) root() string {
+	if c.dir == "" {
+		return wd
+	}
+
+	return c.dir
+}
+
+// describe returns a description of where c came from, for use in errors
+func (c *Config) describe() string {
+	switch {
+	case c == flagConfig:
+		return "the -typed and -untyped flags"
+	case len(c.files) == 0:
+		return fmt.Sprintf("no %v", ConfigFileName)
+	}
+
+	return strings.Join(c.files, ", ")
+}
+
+// pkgConfig returns the config in force for package pName
+func pkgConfig(pName string) *Config {
+	return configFor(pkgInfo[pName].Dir)
+}
+
+// init validates g, parsing its Timeout
+func (g *Generator) init() error {
+	if g.Path == "" {
+		return fmt.Errorf("generator has no Path")
+	}
+
+	if !validCmd.MatchString(g.cmd()) {
+		return fmt.Errorf("%v: invalid go generate cmd %q", g.Path, g.cmd())
+	}
+
+	if g.Phase == "" {
+		return fmt.Errorf("%v: generator has no Phase", g.Path)
+	}
+
+	for _, a := range g.After {
+		if !validCmd.MatchString(a) {
+			return fmt.Errorf("%v: invalid command %q in After", g.Path, a)
+		}
+		if a == g.cmd() {
+			return fmt.Errorf("%v: cannot run after itself", g.Path)
+		}
+	}
+
+	for _, e := range g.Env {
+		if i := strings.Index(e, "="); i < 1 {
+			return fmt.Errorf("%v: Env entry %q is not of the form key=value", g.Path, e)
+		}
+	}
+
+	if g.Timeout != "" {
+		d, err := time.ParseDuration(g.Timeout)
+		if err != nil {
+			return fmt.Errorf("%v: invalid Timeout: %v", g.Path, err)
+		}
+		if d <= 0 {
+			return fmt.Errorf("%v: Timeout must be positive; got %v", g.Path, g.Timeout)
+		}
+
+		g.timeout = d
+	}
+
+	for _, o := range g.Outputs {
+		if _, err := filepath.Match(o, ""); err != nil || strings.ContainsRune(o, filepath.Separator) {
+			return fmt.Errorf("%v: invalid Outputs pattern %q", g.Path, o)
+		}
+	}
+
+	return nil
+}
+
+// findConfig returns the path of the config file that applies in dir, i.e.
+// the first found in dir or any of its parents (up to configCeiling), or the
+// empty string if there is none
+func findConfig(dir string) string {
+	for {
+		f := filepath.Join(dir, ConfigFileName)
+
+		if fi, err := os.Stat(f); err == nil && !fi.IsDir() {
+			return f
+		}
+
+		p := filepath.Dir(dir)
+
+		if p == dir || dir == configCeiling {
+			return ""
+		}
+
+		dir = p
+	}
 }
 
 func splitCmdList(s string) []string {
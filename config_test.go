@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// writeFiles writes files, keyed by slash-separated paths relative to dir
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+
+	for n, src := range files {
+		fn := filepath.Join(dir, filepath.FromSlash(n))
+
+		if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := ioutil.WriteFile(fn, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestConfigFor(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+
+		// ceiling, if set, is the directory (relative to that of the test)
+		// above which config files are not sought
+		ceiling string
+
+		// gens describes each generator as "cmd path phase", sorted
+		gens   []string
+		phases string
+		err    string
+	}{
+		{
+			name:   "no config files",
+			phases: "untyped,typed",
+		},
+		{
+			name: "config above the ceiling",
+			files: map[string]string{
+				".ggconfig.json": `{"Untyped": ["ex/a"]}`,
+			},
+			ceiling: "p",
+			phases:  "untyped,typed",
+		},
+		{
+			name: "inner file extends outer",
+			files: map[string]string{
+				".ggconfig.json":     `{"Root": true, "Untyped": ["ex/a"]}`,
+				"p/.ggconfig.json":   `{"Typed": ["ex/b"]}`,
+				"p/q/.ggconfig.json": `{"Untyped": ["ex/c"]}`,
+			},
+			gens:   []string{"a ex/a untyped", "b ex/b typed", "c ex/c untyped"},
+			phases: "untyped,typed",
+		},
+		{
+			name: "inner file replaces the entry for a command",
+			files: map[string]string{
+				".ggconfig.json":   `{"Root": true, "Typed": ["ex/a", "ex/b"]}`,
+				"p/.ggconfig.json": `{"Untyped": ["other/a"]}`,
+			},
+			gens:   []string{"a other/a untyped", "b ex/b typed"},
+			phases: "untyped,typed",
+		},
+		{
+			name: "Generators entry replaces a list entry in the same file",
+			files: map[string]string{
+				".ggconfig.json": `{"Root": true, "Untyped": ["ex/a"], "Generators": [{"Path": "ex/a", "Phase": "untyped", "Env": ["X=1"]}]}`,
+			},
+			gens:   []string{"a ex/a untyped"},
+			phases: "untyped,typed",
+		},
+		{
+			name: "Root stops the search",
+			files: map[string]string{
+				".ggconfig.json":   `{"Untyped": ["ex/a"]}`,
+				"p/.ggconfig.json": `{"Root": true, "Untyped": ["ex/b"]}`,
+			},
+			gens:   []string{"b ex/b untyped"},
+			phases: "untyped,typed",
+		},
+		{
+			name: "inner Phases take precedence",
+			files: map[string]string{
+				".ggconfig.json":   `{"Root": true, "Phases": [{"Name": "gen", "Generators": ["ex/a"]}]}`,
+				"p/.ggconfig.json": `{"Phases": [{"Name": "gen"}, {"Name": "post", "Generators": ["ex/b"]}]}`,
+			},
+			gens:   []string{"a ex/a gen", "b ex/b post"},
+			phases: "gen,post",
+		},
+		{
+			name: "inherited generator in an undeclared phase",
+			files: map[string]string{
+				".ggconfig.json":   `{"Root": true, "Untyped": ["ex/a"]}`,
+				"p/.ggconfig.json": `{"Phases": [{"Name": "gen", "Generators": ["ex/b"]}]}`,
+			},
+			err: "ex/a runs in phase untyped, which is not one of gen",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := setupCache(t)
+			writeFiles(t, dir, tt.files)
+
+			if tt.ceiling != "" {
+				configCeiling = filepath.Join(dir, tt.ceiling)
+			}
+
+			var c *Config
+
+			err := catch(func() {
+				c = configFor(filepath.Join(dir, "p", "q"))
+			})
+
+			if tt.err != "" {
+				if err == nil || !strings.Contains(fmt.Sprint(err), tt.err) {
+					t.Fatalf("got error %v; want %q", err, tt.err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var gens []string
+			for cmd, g := range c.gens {
+				gens = append(gens, fmt.Sprintf("%v %v %v", cmd, g.Path, g.Phase))
+			}
+
+			sort.Strings(gens)
+
+			if !reflect.DeepEqual(gens, tt.gens) {
+				t.Errorf("generators:\n%q\nwant:\n%q", gens, tt.gens)
+			}
+
+			if got := phaseNames(c.phases); got != tt.phases {
+				t.Errorf("phases %v; want %v", got, tt.phases)
+			}
+		})
+	}
+}
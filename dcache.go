@@ -0,0 +1,306 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"myitcv.io/gogenerate"
+)
+
+const (
+	dirCacheDirName  = "directives"
+	blobCacheDirName = "blobs"
+)
+
+// cacheEnv are the environment variables, beyond those set per directive
+// (see directive.env), that are considered part of the input to a directive
+var cacheEnv = []string{
+	"CGO_ENABLED",
+	"GO111MODULE",
+	"GOEXPERIMENT",
+	"GOFLAGS",
+	"GOPATH",
+}
+
+// dirCacheEntry records the effect of running a directive: the files it
+// created or modified in its directory (the contents of which are stored
+// as blobs keyed by hash), the files it removed and its output
+type dirCacheEntry struct {
+	Outputs []dirCacheOutput
+	Removed []string
+	Output  string
+}
+
+type dirCacheOutput struct {
+	Name string
+	Hash string
+	Mode os.FileMode
+}
+
+// dirHashes returns the hash of each regular file in dir, keyed by name
+func dirHashes(dir string) (map[string]string, error) {
+	defer times.since(timeHashing, "directories", time.Now())
+
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make(map[string]string, len(fis))
+
+	for _, fi := range fis {
+		if !fi.Mode().IsRegular() {
+			continue
+		}
+
+		h, err := hashFile(filepath.Join(dir, fi.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		res[fi.Name()] = h
+	}
+
+	return res, nil
+}
+
+func hashFile(fn string) (string, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha1.New()
+
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// cacheKey returns the key under which the effect of running d is cached,
+// given the hashes of the files in its directory (see dirHashes) before it
+// runs. The key covers those files, the directive's arguments and
+// environment, the generator executable and, for phases that require
+// compiled dependencies, the files of all packages the directive's package depends on.
+// The boolean result is false if d cannot be cached, for example because it
+// writes to other packages
+func (d directive) cacheKey(phase string, files map[string]string) (string, bool) {
+	for _, a := range d.args {
+		if strings.HasPrefix(strings.TrimLeft(a, "-"), gogenerate.FlagOutPkgPrefix) {
+			return "", false
+		}
+	}
+
+	bin, err := d.cmdPath()
+	if err != nil {
+		return "", false
+	}
+
+	bh, err := fileFingerprint(bin)
+	if err != nil {
+		return "", false
+	}
+
+	h := sha1.New()
+
+	fmt.Fprintf(h, "phase %v\n", phase)
+	fmt.Fprintf(h, "bin %v\n", bh)
+
+	for _, a := range d.args {
+		fmt.Fprintf(h, "arg %q\n", a)
+	}
+
+	// the iteration is not an input: a directive whose inputs are unchanged
+	// from an earlier iteration has the same effect, which generators are
+	// required to ensure (see Generator)
+	for _, e := range d.env(phase, "") {
+		fmt.Fprintf(h, "env %v\n", e)
+	}
+
+	for _, e := range cacheEnv {
+		fmt.Fprintf(h, "env %v=%v\n", e, os.Getenv(e))
+	}
+
+	for _, n := range sortedKeys(files) {
+		fmt.Fprintf(h, "file %v %v\n", n, files[n])
+	}
+
+	if pkgConfig(d.pkg).compiled(phase) {
+		dh, err := depsHash(pkgInfo[d.pkg])
+		if err != nil {
+			return "", false
+		}
+
+		fmt.Fprintf(h, "deps %v\n", dh)
+	}
+
+	return fmt.Sprintf("%x", h.Sum(nil)), true
+}
+
+// depsHash returns a hash of the files of all non-standard packages on which
+// pkg depends
+func depsHash(pkg *Package) (string, error) {
+	deps := keySlice(allDeps(pkg))
+	sort.Strings(deps)
+
+	h := sha1.New()
+
+	for _, d := range deps {
+		dp, ok := pkgInfo[d]
+		if !ok {
+			dp = extPkgs[d]
+		}
+
+		if dp == nil {
+			fmt.Fprintf(h, "pkg %v unknown\n", d)
+			continue
+		}
+
+		if dp.Standard {
+			continue
+		}
+
+		files, err := dirHashes(dp.Dir)
+		if err != nil {
+			return "", err
+		}
+
+		fmt.Fprintf(h, "pkg %v\n", d)
+
+		for _, n := range sortedKeys(files) {
+			fmt.Fprintf(h, "file %v %v\n", n, files[n])
+		}
+	}
+
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+func dirCacheFile(key string) string {
+	return filepath.Join(ggCacheDir(), dirCacheDirName, key)
+}
+
+func blobFile(hash string) string {
+	return filepath.Join(ggCacheDir(), blobCacheDirName, hash)
+}
+
+// restoreDirCache applies the cached effect of the directive with the given
+// key to dir, returning false if there is no such entry
+func restoreDirCache(key string, dir string, out io.Writer) (bool, error) {
+	b, err := ioutil.ReadFile(dirCacheFile(key))
+	if err != nil {
+		return false, nil
+	}
+
+	var e dirCacheEntry
+
+	if err := json.Unmarshal(b, &e); err != nil {
+		return false, nil
+	}
+
+	// check we have everything we need before touching dir
+	contents := make([][]byte, len(e.Outputs))
+
+	for i, o := range e.Outputs {
+		c, err := ioutil.ReadFile(blobFile(o.Hash))
+		if err != nil {
+			return false, nil
+		}
+
+		contents[i] = c
+	}
+
+	for i, o := range e.Outputs {
+		if err := ioutil.WriteFile(filepath.Join(dir, o.Name), contents[i], o.Mode); err != nil {
+			return false, err
+		}
+	}
+
+	for _, r := range e.Removed {
+		if err := os.Remove(filepath.Join(dir, r)); err != nil && !os.IsNotExist(err) {
+			return false, err
+		}
+	}
+
+	io.WriteString(out, e.Output)
+
+	return true, nil
+}
+
+// saveDirCache records the effect of a directive that ran in dir: before and
+// after are the results of dirHashes prior to and after it running
+func saveDirCache(key string, dir string, before, after map[string]string, output string) error {
+	for _, d := range []string{dirCacheDirName, blobCacheDirName} {
+		if err := os.MkdirAll(filepath.Join(ggCacheDir(), d), 0755); err != nil {
+			return err
+		}
+	}
+
+	e := dirCacheEntry{
+		Output: output,
+	}
+
+	for _, n := range sortedKeys(after) {
+		if h, ok := before[n]; ok && h == after[n] {
+			continue
+		}
+
+		fn := filepath.Join(dir, n)
+
+		fi, err := os.Stat(fn)
+		if err != nil {
+			return err
+		}
+
+		bf := blobFile(after[n])
+
+		if _, err := os.Stat(bf); err != nil {
+			c, err := ioutil.ReadFile(fn)
+			if err != nil {
+				return err
+			}
+
+			if err := writeFileAtomic(bf, c); err != nil {
+				return err
+			}
+		}
+
+		e.Outputs = append(e.Outputs, dirCacheOutput{Name: n, Hash: after[n], Mode: fi.Mode()})
+	}
+
+	for _, n := range sortedKeys(before) {
+		if _, ok := after[n]; !ok {
+			e.Removed = append(e.Removed, n)
+		}
+	}
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(dirCacheFile(key), b)
+}
+
+// sortedKeys returns the keys of m in order
+func sortedKeys(m map[string]string) []string {
+	res := make([]string, 0, len(m))
+
+	for k := range m {
+		res = append(res, k)
+	}
+
+	sort.Strings(res)
+
+	return res
+}
@@ -0,0 +1,167 @@
+package main
+
+import "sort"
+
+// pkgDeps maps the import path of each package in pkgInfo to the set of
+// packages in pkgInfo on which it (transitively) depends, including via its
+// tests. Imports via packages outside of pkgInfo are followed, hence a change
+// in one package can be seen to affect another even if the two are separated
+// by any number of intermediate packages
+var pkgDeps = map[string]map[string]struct{}{}
+
+// extPkgs holds the packages outside of pkgInfo on which packages in pkgInfo
+// (transitively) depend, including via their tests
+var extPkgs = map[string]*Package{}
+
+// loadDeps (re)computes pkgDeps and extPkgs from the output of go list
+func loadDeps() {
+	var missing []string
+	seen := make(map[string]struct{})
+
+	for _, pkg := range pkgInfo {
+		for _, i := range append(pkg.testImports(), pkg.Deps...) {
+			if _, ok := pkgInfo[i]; ok {
+				continue
+			}
+			if _, ok := seen[i]; ok {
+				continue
+			}
+
+			seen[i] = struct{}{}
+			missing = append(missing, i)
+		}
+	}
+
+	extPkgs = make(map[string]*Package)
+
+	if len(missing) > 0 {
+		sort.Strings(missing)
+
+		// go list does not report the transitive dependencies of tests, hence
+		// we need -deps to be sure of having the Deps of any test imports
+		for _, p := range goList(append([]string{"-deps"}, missing...)...) {
+			if _, ok := pkgInfo[p.ImportPath]; !ok {
+				extPkgs[p.ImportPath] = p
+			}
+		}
+	}
+
+	pkgDeps = make(map[string]map[string]struct{}, len(pkgInfo))
+
+	for p, pkg := range pkgInfo {
+		d := make(map[string]struct{})
+
+		for i := range allDeps(pkg) {
+			if _, ok := pkgInfo[i]; ok {
+				d[i] = struct{}{}
+			}
+		}
+
+		pkgDeps[p] = d
+	}
+}
+
+// allDeps returns the import paths of all packages on which pkg transitively
+// depends, including via its tests. extPkgs must be current
+func allDeps(pkg *Package) map[string]struct{} {
+	res := make(map[string]struct{})
+
+	for _, i := range pkg.Deps {
+		res[i] = struct{}{}
+	}
+
+	for _, i := range pkg.testImports() {
+		res[i] = struct{}{}
+
+		ip, ok := pkgInfo[i]
+		if !ok {
+			ip = extPkgs[i]
+		}
+
+		if ip != nil {
+			for _, d := range ip.Deps {
+				res[d] = struct{}{}
+			}
+		}
+	}
+
+	delete(res, pkg.ImportPath)
+
+	return res
+}
+
+// dependents returns the subset of universe that either is in pkgs or
+// (transitively) depends on a package in pkgs
+func dependents(pkgs []string, universe []string) []string {
+	changed := make(map[string]struct{}, len(pkgs))
+	for _, p := range pkgs {
+		changed[p] = struct{}{}
+	}
+
+	var res []string
+
+Universe:
+	for _, u := range universe {
+		if _, ok := changed[u]; ok {
+			res = append(res, u)
+			continue
+		}
+
+		for d := range pkgDeps[u] {
+			if _, ok := changed[d]; ok {
+				res = append(res, u)
+				continue Universe
+			}
+		}
+	}
+
+	return res
+}
+
+// topoSort returns pkgs ordered such that each package appears after all of
+// the packages in pkgs on which it depends. Ties are broken by import path
+// so that the order is stable between runs
+func topoSort(pkgs []string) []string {
+	sorted := append([]string(nil), pkgs...)
+	sort.Strings(sorted)
+
+	in := make(map[string]struct{}, len(pkgs))
+	for _, p := range pkgs {
+		in[p] = struct{}{}
+	}
+
+	res := make([]string, 0, len(pkgs))
+	done := make(map[string]bool, len(pkgs))
+
+	var visit func(p string)
+
+	visit = func(p string) {
+		if _, ok := done[p]; ok {
+			return
+		}
+
+		// mark before visiting deps to protect against cycles
+		done[p] = false
+
+		deps := make([]string, 0, len(pkgDeps[p]))
+		for d := range pkgDeps[p] {
+			if _, ok := in[d]; ok {
+				deps = append(deps, d)
+			}
+		}
+		sort.Strings(deps)
+
+		for _, d := range deps {
+			visit(d)
+		}
+
+		done[p] = true
+		res = append(res, p)
+	}
+
+	for _, p := range sorted {
+		visit(p)
+	}
+
+	return res
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"go/build"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"myitcv.io/gogenerate"
+)
+
+// directive is a single go generate directive within a package
+type directive struct {
+	pkg  string
+	file string // absolute path
+	line int
+
+	// gopackage is the name of the package of the file containing the
+	// directive, per $GOPACKAGE
+	gopackage string
+
+	// args are the directive's arguments after quote, -command and variable
+	// expansion as described by go generate -help
+	args []string
+}
+
+// cmd returns the base name of the command run by the directive, i.e. the
+// name by which it is referred to in the config
+func (d directive) cmd() string {
+	return filepath.Base(d.args[0])
+}
+
+// generator returns the settings for the generator run by the directive
+func (d directive) generator() *Generator {
+	return pkgConfig(d.pkg).generator(d.cmd())
+}
+
+func (d directive) pos() string {
+	return fmt.Sprintf("%v:%v", relPath(d.file), d.line)
+}
+
+func (d directive) String() string {
+	return fmt.Sprintf("%v: %v", d.pos(), strings.Join(d.args, " "))
+}
+
+// outPkgs returns the packages named by the directive's outpkg: flags (see
+// gogenerate.OutPkgFlag), i.e. the packages other than its own into which
+// the generator writes
+func (d directive) outPkgs() []string {
+	var res []string
+
+	for i := 1; i < len(d.args); i++ {
+		a := strings.TrimLeft(d.args[i], "-")
+
+		if !strings.HasPrefix(a, gogenerate.FlagOutPkgPrefix) {
+			continue
+		}
+
+		if j := strings.Index(a, "="); j != -1 {
+			res = append(res, a[j+1:])
+		} else if i+1 < len(d.args) {
+			i++
+			res = append(res, d.args[i])
+		}
+	}
+
+	return res
+}
+
+// the environment variables gg sets, in addition to those set by go
+// generate, to give generators the context in which they run (see ggEnv)
+const (
+	envPhase     = "GG_PHASE"
+	envIteration = "GG_ITERATION"
+	envRoot      = "GG_ROOT"
+	envPackages  = "GG_PACKAGES"
+)
+
+// ggEnv returns the gg environment variables for a run of a generator in
+// iteration it (see generate) of phase for pkgs, a single package unless
+// the generator is a batch generator. root is the directory holding the
+// config in force. GG_ITERATION is omitted if it is empty. It is for logging
+// and diagnostics only: it is not part of the key under which the effect of
+// a directive is cached (see cacheKey), and so a generator must not vary its
+// output by iteration
+func ggEnv(phase, it, root string, pkgs []string) []string {
+	env := []string{
+		envPhase + "=" + phase,
+		envRoot + "=" + root,
+		envPackages + "=" + strings.Join(pkgs, " "),
+	}
+
+	if it != "" {
+		env = append(env, envIteration+"="+it)
+	}
+
+	return env
+}
+
+// env returns the additional environment variables that go generate sets
+// when running a directive in iteration it of phase, followed by the gg
+// environment variables (see ggEnv) and then those from the config for its
+// generator, which therefore take precedence
+func (d directive) env(phase, it string) []string {
+	env := []string{
+		"GOARCH=" + build.Default.GOARCH,
+		"GOOS=" + build.Default.GOOS,
+		"GOROOT=" + build.Default.GOROOT,
+		"GOFILE=" + filepath.Base(d.file),
+		"GOLINE=" + strconv.Itoa(d.line),
+		"GOPACKAGE=" + d.gopackage,
+		"DOLLAR=" + "$",
+	}
+
+	env = append(env, ggEnv(phase, it, pkgConfig(d.pkg).root(), []string{d.pkg})...)
+
+	return append(env, d.generator().Env...)
+}
+
+// run runs the directive in iteration it of phase in the directory of the
+// file that contains it, as go generate would, writing its combined output
+// to out
+func (d directive) run(phase, it string, out io.Writer) error {
+	return runGenerator(d.generator(), filepath.Dir(d.file), d.args, d.env(phase, it), out)
+}
+
+// pkgDirectives returns the directives in package pName in the order in which
+// go generate would run them
+func pkgDirectives(pName string) ([]directive, error) {
+	var res []directive
+
+	pkg := pkgInfo[pName]
+
+	xtest := make(map[string]bool, len(pkg.XTestGoFiles))
+	for _, f := range pkg.XTestGoFiles {
+		xtest[f] = true
+	}
+
+	for _, fn := range pkg.goFiles() {
+		f := filepath.Join(pkg.Dir, fn)
+
+		gopackage := pkg.Name
+		if xtest[fn] {
+			gopackage += "_test"
+		}
+
+		visitDir := func(line int, dirArgs []string) error {
+			res = append(res, directive{
+				pkg:       pName,
+				file:      f,
+				line:      line,
+				gopackage: gopackage,
+				args:      dirArgs,
+			})
+
+			return nil
+		}
+
+		if err := gogenerate.DirFunc(gopackage, pkg.Dir, fn, visitDir); err != nil {
+			return nil, err
+		}
+	}
+
+	return res, nil
+}
+
+func relPath(f string) string {
+	rel, err := filepath.Rel(wd, f)
+	if err != nil {
+		fatalf("could not create filepath.Rel(%q, %q): %q", wd, f, err)
+	}
+
+	return rel
+}
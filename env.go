@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// env implements gg env. It reports the config in force for a package in
+// the working directory (see configFor)
+func env(args []string) {
+	loadConfig()
+
+	c := configFor(wd)
+
+	var bins []string
+	seen := make(map[string]bool)
+
+	// only generators declared by import path are built (see
+	// buildGenerators); bare command names are found on PATH
+	for _, g := range c.entries {
+		if g.dir != "" && strings.Contains(g.Path, "/") && !seen[g.dir] {
+			seen[g.dir] = true
+			bins = append(bins, genBinDir(g.dir))
+		}
+	}
+
+	list := string(os.PathListSeparator)
+
+	vars := []struct {
+		name, value string
+	}{
+		{"GGCONFIG", strings.Join(c.files, list)},
+		{"GGROOT", c.dir},
+		{"GGTYPED", strings.Join(c.Typed, ",")},
+		{"GGUNTYPED", strings.Join(c.Untyped, ",")},
+		{"GGPHASES", phaseNames(c.phases)},
+		{"GGCOMPILER", c.Compiler},
+		{"GGCACHE", ggCacheDir()},
+		{"GGBIN", strings.Join(bins, list)},
+	}
+
+	if len(args) == 0 {
+		for _, v := range vars {
+			fmt.Printf("%v=%q\n", v.name, v.value)
+		}
+
+		return
+	}
+
+Args:
+	for _, a := range args {
+		for _, v := range vars {
+			if v.name == a {
+				fmt.Println(v.value)
+				continue Args
+			}
+		}
+
+		fatalf("unknown variable %v", a)
+	}
+}
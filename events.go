@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// The actions of the events that make up the -json event stream
+const (
+	evStart          = "start"           // Packages: the package patterns
+	evLoad           = "load"            // Package, Dir
+	evStale          = "stale"           // Package, Hash, Stale
+	evIteration      = "iteration"       // Phase, Iteration
+	evGenerateStart  = "generate-start"  // Package, Phase
+	evGenerateEnd    = "generate-end"    // Package, Phase, Elapsed, Error, Output
+	evDirectiveStart = "directive-start" // Package, Phase, File, Line, Args
+	evDirectiveEnd   = "directive-end"   // Package, Phase, File, Line, Args, Elapsed, ExitCode, Cached, Error, Output
+	evRemove         = "remove"          // Package, File
+	evInstall        = "install"         // Package, Failed
+	evSummary        = "summary"         // Packages, FailedPackages, Elapsed
+	evError          = "error"           // Error
+)
+
+// event is a single entry in the -json event stream, written as one JSON
+// object per line to stdout. Fields not relevant to an action are omitted
+type event struct {
+	Time      time.Time
+	Action    string
+	Package   string   `json:",omitempty"`
+	Packages  []string `json:",omitempty"`
+	Dir       string   `json:",omitempty"`
+	File      string   `json:",omitempty"`
+	Line      int      `json:",omitempty"`
+	Args      []string `json:",omitempty"`
+	Phase     string   `json:",omitempty"`
+	Iteration string   `json:",omitempty"`
+	Hash      string   `json:",omitempty"`
+	Stale     *bool    `json:",omitempty"`
+	Failed    *bool    `json:",omitempty"`
+	Cached    *bool    `json:",omitempty"`
+
+	// Elapsed is in seconds
+	Elapsed  float64 `json:",omitempty"`
+	ExitCode *int    `json:",omitempty"`
+	Error    string  `json:",omitempty"`
+	Output   string  `json:",omitempty"`
+
+	FailedPackages []string `json:",omitempty"`
+}
+
+var (
+	eventLock sync.Mutex
+	eventEnc  = json.NewEncoder(os.Stdout)
+)
+
+// emit writes e to the event stream if -json was specified. It is safe to
+// call emit concurrently
+func emit(e event) {
+	if !*fJSON {
+		return
+	}
+
+	e.Time = time.Now()
+
+	eventLock.Lock()
+	defer eventLock.Unlock()
+
+	if err := eventEnc.Encode(e); err != nil {
+		// no point trying to emit an event about this
+		panic(err)
+	}
+}
+
+// exitCode returns the exit code of a process given the error returned from
+// running it, or -1 if the process could not be run
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+
+	var ee *exec.ExitError
+	if errors.As(err, &ee) {
+		return ee.ExitCode()
+	}
+
+	return -1
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
+
+func intPtr(i int) *int {
+	return &i
+}
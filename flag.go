@@ -4,19 +4,58 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"runtime"
 	"strings"
+	"time"
 )
 
+// the flags are shared between the subcommands; each subcommand registers
+// those that apply to it on its own flag.FlagSet (see cmd.go)
 var (
 	fXPkgs    xPkgs
-	fVVerbose = flag.Bool("vv", false, "output commands as they are executed")
-	fList     = flag.Bool("l", false, "list go generate directive commands in packages")
-	fVerbose  = flag.Bool("v", false, "print the names of packages and files as they are processed")
-	fExecute  = flag.Bool("x", false, "print commands as they are executed")
-	fUntyped  = flag.String("untyped", "", "a list of untyped generators to run")
-	fTyped    = flag.String("typed", "", "a list of typed generators to run")
+	fVVerbose = new(bool)
+	fList     = new(bool)
+	fVerbose  = new(bool)
+	fExecute  = new(bool)
+	fUntyped  = new(string)
+	fTyped    = new(string)
+	fCompiler = new(string)
+	fNoBuild  = new(bool)
+	fForce    = new(bool)
+	fDryRun   = new(bool)
+	fCheck    = new(bool)
+	fJSON     = new(bool)
+	fWatch    = new(bool)
+	fParallel = new(int)
+	fTimeout  = new(time.Duration)
+	fTimings  timingsFlag
+	fCleanGen = new(string)
+
+	fGraphFormat = new(string)
 )
 
+// addLoadFlags registers the flags that control which packages and
+// generators gg considers
+func addLoadFlags(fs *flag.FlagSet) {
+	fs.BoolVar(fVVerbose, "vv", false, "output commands as they are executed")
+	fs.StringVar(fUntyped, "untyped", "", "a list of untyped generators to run")
+	fs.StringVar(fTyped, "typed", "", "a list of typed generators to run")
+	fs.Var(&fXPkgs, "X", "packages to exclude")
+}
+
+// addGenFlags registers the flags that control how generation is run
+func addGenFlags(fs *flag.FlagSet) {
+	fs.BoolVar(fVerbose, "v", false, "print the names of packages and files as they are processed")
+	fs.BoolVar(fExecute, "x", false, "print commands as they are executed")
+	fs.StringVar(fCompiler, "compiler", "", "the backend used to compile packages (overrides the config): "+strings.Join(compilerNames(), ", "))
+	fs.BoolVar(fNoBuild, "nobuild", false, "do not build the generators listed in the config; use those previously built or on PATH")
+	fs.BoolVar(fForce, "f", false, "ignore the staleness and directive caches, regenerating all packages")
+	fs.BoolVar(fJSON, "json", false, "write a stream of JSON events describing the run to stdout")
+	fs.IntVar(fParallel, "p", runtime.GOMAXPROCS(0), "the number of packages that can be generated in parallel")
+	fs.DurationVar(fTimeout, "timeout", 0, "if positive, the longest a run may take, after which running generators are killed; with -watch, each regeneration is a run")
+	fs.Var(&fTimings, "timings", "at the end of the run print a table of the time spent per generator, package, phase and iteration, in go install and hashing; -timings=file writes the table to file")
+}
+
 type xPkgs []string
 
 func (i *xPkgs) Set(value string) error {
@@ -31,7 +70,3 @@ func (i *xPkgs) Set(value string) error {
 func (i *xPkgs) String() string {
 	return fmt.Sprint(*i)
 }
-
-func init() {
-	flag.Var(&fXPkgs, "X", "packages to exclude")
-}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	binDirName    = "bin"
+	binStampsName = ".stamps.json"
+)
+
+type fingerprint struct {
+	size int64
+	mod  int64
+	hash string
+}
+
+var (
+	fingerprintLock sync.Mutex
+	fingerprints    = make(map[string]fingerprint)
+)
+
+// fileFingerprint returns the content hash of the file fn, recomputing it
+// only if the file's size or modification time has changed since the last
+// call. It is safe to call from any goroutine
+func fileFingerprint(fn string) (string, error) {
+	fi, err := os.Stat(fn)
+	if err != nil {
+		return "", err
+	}
+
+	fingerprintLock.Lock()
+	fp, ok := fingerprints[fn]
+	fingerprintLock.Unlock()
+
+	if ok && fp.size == fi.Size() && fp.mod == fi.ModTime().UnixNano() {
+		return fp.hash, nil
+	}
+
+	h, err := hashFile(fn)
+	if err != nil {
+		return "", err
+	}
+
+	fingerprintLock.Lock()
+	fingerprints[fn] = fingerprint{size: fi.Size(), mod: fi.ModTime().UnixNano(), hash: h}
+	fingerprintLock.Unlock()
+
+	return h, nil
+}
+
+// cmdPath returns the path of the executable that running d would execute
+// (see runGenerator)
+func (d directive) cmdPath() (string, error) {
+	c := d.args[0]
+
+	if strings.ContainsRune(c, filepath.Separator) {
+		if !filepath.IsAbs(c) {
+			c = filepath.Join(filepath.Dir(d.file), c)
+		}
+
+		return c, nil
+	}
+
+	if b := d.generator().bin(); b != "" {
+		return b, nil
+	}
+
+	return exec.LookPath(c)
+}
+
+// generatorFingerprints returns the fingerprint (see fileFingerprint) of the
+// executable of each configured generator used by the directives in package
+// pName, keyed by command. A generator whose executable cannot be found has
+// an empty fingerprint
+func generatorFingerprints(pName string) map[string]string {
+	dirs, err := pkgDirectives(pName)
+	if err != nil {
+		fatalf("could not read directives in %v: %v", pName, err)
+	}
+
+	res := make(map[string]string)
+
+	cfg := pkgConfig(pName)
+
+	for _, d := range dirs {
+		c := d.cmd()
+
+		if _, ok := res[c]; ok {
+			continue
+		}
+
+		if cfg.phase(c) == "" {
+			continue
+		}
+
+		res[c] = ""
+
+		bin, err := d.cmdPath()
+		if err != nil {
+			vvlogf("could not find generator %v: %v", c, err)
+			continue
+		}
+
+		fp, err := fileFingerprint(bin)
+		if err != nil {
+			vvlogf("could not fingerprint generator %v: %v", bin, err)
+			continue
+		}
+
+		res[c] = fp
+	}
+
+	return res
+}
+
+// changedGenerators returns the commands whose fingerprints differ between
+// prev and cur, in order
+func changedGenerators(prev, cur map[string]string) []string {
+	var res []string
+
+	for c, fp := range cur {
+		if pfp, ok := prev[c]; !ok || pfp != fp {
+			res = append(res, c)
+		}
+	}
+
+	for c := range prev {
+		if _, ok := cur[c]; !ok {
+			res = append(res, c)
+		}
+	}
+
+	sort.Strings(res)
+
+	return res
+}
+
+// genBinDir returns the private directory into which the generators declared
+// by the config file in dir are installed. Different configs get different
+// directories because they may resolve the same import path to different
+// sources
+func genBinDir(dir string) string {
+	return filepath.Join(ggCacheDir(), binDirName, fmt.Sprintf("%x", sha1.Sum([]byte(dir))))
+}
+
+// bin returns the path of the build of g installed by buildGenerators, or the
+// empty string if g is not installed by gg or has not yet been built
+func (g *Generator) bin() string {
+	if g.dir == "" || !strings.Contains(g.Path, "/") {
+		return ""
+	}
+
+	b := filepath.Join(genBinDir(g.dir), g.cmd())
+
+	if _, err := os.Stat(b); err != nil {
+		return ""
+	}
+
+	return b
+}
+
+// buildGenerators installs the generators declared by import path in the
+// configs in force for pkgs. Each generator is installed into the genBinDir
+// of the config file that declares it, and directives then run that build
+// (see runGenerator). Only generators whose sources (including those of their
+// non-standard dependencies) have changed since they were last installed are
+// rebuilt. Entries that are bare command names (for example from -typed) are
+// expected to be on PATH already. If install is false nothing is built but
+// previously installed generators are still used
+func buildGenerators(install bool, pkgs []string) {
+	if !install {
+		return
+	}
+
+	byDir := make(map[string]map[string]struct{})
+
+	for _, p := range pkgs {
+		for _, g := range pkgConfig(p).entries {
+			if g.dir == "" || !strings.Contains(g.Path, "/") {
+				continue
+			}
+
+			if byDir[g.dir] == nil {
+				byDir[g.dir] = make(map[string]struct{})
+			}
+
+			byDir[g.dir][g.Path] = struct{}{}
+		}
+	}
+
+	dirs := make([]string, 0, len(byDir))
+	for d := range byDir {
+		dirs = append(dirs, d)
+	}
+
+	sort.Strings(dirs)
+
+	for _, d := range dirs {
+		installGenerators(d, keySlice(byDir[d]))
+	}
+}
+
+// installGenerators installs those of paths, the import paths of generators
+// declared by the config file in dir, that are stale into genBinDir(dir)
+func installGenerators(dir string, paths []string) {
+	bin := genBinDir(dir)
+
+	sort.Strings(paths)
+
+	hashes := generatorSourceHashes(dir, paths)
+
+	stampsFile := filepath.Join(bin, binStampsName)
+	stamps := make(map[string]string)
+
+	if b, err := ioutil.ReadFile(stampsFile); err == nil {
+		if err := json.Unmarshal(b, &stamps); err != nil {
+			vvlogf("ignoring corrupt %v: %v", stampsFile, err)
+		}
+	}
+
+	var stale []string
+
+	for _, p := range paths {
+		_, err := os.Stat(filepath.Join(bin, filepath.Base(p)))
+
+		if err != nil || stamps[p] != hashes[p] {
+			stale = append(stale, p)
+		}
+	}
+
+	if len(stale) == 0 {
+		return
+	}
+
+	if err := os.MkdirAll(bin, 0755); err != nil {
+		fatalf("could not create %v: %v", bin, err)
+	}
+
+	args := append([]string{"install"}, stale...)
+
+	xlogf("GOBIN=%v go %v", bin, strings.Join(args, " "))
+
+	cmd := exec.Command("go", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GOBIN="+bin)
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		fatalf("could not install generators: %v\n%s", err, out)
+	}
+
+	for _, p := range stale {
+		stamps[p] = hashes[p]
+	}
+
+	b, err := json.Marshal(stamps)
+	if err != nil {
+		fatalf("could not marshal generator stamps: %v", err)
+	}
+
+	if err := writeFileAtomic(stampsFile, b); err != nil {
+		fatalf("could not write generator stamps: %v", err)
+	}
+}
+
+// generatorSourceHashes returns, for each of the generator import paths,
+// a hash of the files of the generator package and of its non-standard
+// dependencies
+func generatorSourceHashes(dir string, paths []string) map[string]string {
+	pkgs := make(map[string]*Package)
+
+	// we list from the config directory so that in module mode the paths
+	// resolve in the module that declares the generators
+	list := goListDir(dir, append([]string{"-deps"}, paths...)...)
+
+	for _, p := range list {
+		pkgs[p.ImportPath] = p
+	}
+
+	dirs := make(map[string]string)
+
+	dirHash := func(dir string) string {
+		if h, ok := dirs[dir]; ok {
+			return h
+		}
+
+		files, err := dirHashes(dir)
+		if err != nil {
+			fatalf("could not hash %v: %v", dir, err)
+		}
+
+		h := sha1.New()
+		for _, n := range sortedKeys(files) {
+			fmt.Fprintf(h, "file %v %v\n", n, files[n])
+		}
+
+		dirs[dir] = fmt.Sprintf("%x", h.Sum(nil))
+
+		return dirs[dir]
+	}
+
+	res := make(map[string]string)
+
+	for _, path := range paths {
+		p, ok := pkgs[path]
+		if !ok || p.Dir == "" {
+			fatalf("could not find generator package %v", path)
+		}
+
+		h := sha1.New()
+
+		fmt.Fprintf(h, "pkg %v %v\n", path, dirHash(p.Dir))
+
+		for _, d := range p.Deps {
+			if dp, ok := pkgs[d]; ok && !dp.Standard && dp.Dir != "" {
+				fmt.Fprintf(h, "pkg %v %v\n", d, dirHash(dp.Dir))
+			}
+		}
+
+		res[path] = fmt.Sprintf("%x", h.Sum(nil))
+	}
+
+	return res
+}
@@ -6,26 +6,27 @@ package main // import "myitcv.io/gg"
 // gg is a wrapper for ``go generate''. More docs to follow
 
 import (
-	"bufio"
 	"bytes"
-	"flag"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
-	"os/exec"
 	"path/filepath"
-	"regexp"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/kisielk/gotool"
 	"myitcv.io/gogenerate"
 )
 
 const (
-	untypedLoopLimit = 10
-	typedLoopLimit   = untypedLoopLimit
+	// phaseLoopLimit is the most times a phase that does not require
+	// compiled dependencies runs in a round before it must stop changing
+	// packages; roundLoopLimit is the most rounds of the pipeline
+	phaseLoopLimit = 10
+	roundLoopLimit = phaseLoopLimit
 )
 
 var (
@@ -46,288 +47,672 @@ func main() {
 	defer func() {
 		err := recover()
 		if err != nil {
+			emit(event{Action: evError, Error: fmt.Sprint(err)})
 			log.Fatalln(err)
 		}
 	}()
 
-	flag.Parse()
+	c, args := parseCommand(os.Args[1:])
+	if c == nil {
+		return
+	}
+
+	c.flags.Parse(args)
 
 	wd, err = os.Getwd()
 	if err != nil {
 		fatalf("could not get working directory: %v", err)
 	}
 
+	c.run(c.flags.Args())
+}
+
+// list implements gg list
+func list(args []string) {
+	*fList = true
+	run(args)
+}
+
+// check implements gg check
+func check(args []string) {
+	*fCheck = true
+	run(args)
+}
+
+// run implements gg run
+func run(args []string) {
+	if *fParallel < 1 {
+		fatalf("-p must be at least 1; got %v", *fParallel)
+	}
+
+	if *fJSON && (*fList || *fDryRun) {
+		fatalf("-json cannot be used with -l or -n")
+	}
+
 	loadConfig()
 
-	specs := gotool.ImportPaths(flag.Args())
-	sort.Strings(specs)
+	defer reportTimings()
 
-	readPkgs(specs, true)
+	handleInterrupts()
 
-	pkgs := make([]string, 0, len(pkgInfo))
-	for k := range pkgInfo {
-		pkgs = append(pkgs, k)
+	emit(event{Action: evStart, Packages: args})
+
+	start := time.Now()
+
+	if *fWatch {
+		if *fDryRun || *fCheck || *fList {
+			fatalf("-n, -l and -check cannot be used with -watch")
+		}
+
+		watch(args)
 	}
 
-	pkgs = cmdList(pkgs)
+	all := loadPkgs(args)
+
+	if *fCheck {
+		// in check mode we are interested in whether generation changes
+		// anything, so the staleness cache is irrelevant
+		*fForce = true
+
+		snap, err := takeSnapshot(pkgDirs(all))
+		if err != nil {
+			fatalf("could not snapshot packages: %v", err)
+		}
+
+		defer func() {
+			err := recover()
+
+			cs, rerr := snap.restore()
+
+			if err != nil {
+				panic(err)
+			}
+
+			if rerr != nil {
+				fatalf("could not undo the changes of -check: %v", rerr)
+			}
+
+			reportCheck(cs)
+		}()
+	}
+
+	pkgs := cmdList(all, !*fList)
 
 	if len(pkgs) == 0 {
 		vvlogf("No packages contain any directives")
-		os.Exit(0)
+		emitSummary(nil, nil, start)
+		return
 	}
 
 	if *fList {
 		// cmdList above will have done the logging for us
 
-		os.Exit(0)
+		return
 	}
 
-	untypedRunExp := buildGoGenRegex(config.Untyped)
-	typedRunExp := buildGoGenRegex(config.Typed)
+	buildGenerators(!*fDryRun && !*fNoBuild, pkgs)
 
-	diffs := computeStale(pkgs, false)
+	// every package is hashed, not just those with directives, because a
+	// change to any package affects the packages that depend on it
+	stale := computeStale(all, false)
 
-	typedCount := 1
+	loadDeps()
 
-	for {
-		untypedCount := 1
+	if !*fForce {
+		stale = cacheStale(stale)
 
-		preUntyped := snapHash(diffs)
+		if len(stale) == 0 && !*fDryRun {
+			vvlogf("All packages are up to date")
 
-		for len(diffs) > 0 {
-			if untypedCount > untypedLoopLimit {
-				fatalf("Exceeded loop limit for untyped go generate cmd: %v\n", untypedRunExp)
+			for _, p := range pkgs {
+				emit(event{Action: evStale, Package: p, Hash: pkgInfo[p].pkgHash, Stale: boolPtr(false)})
 			}
 
-			vvlogf("Untyped iteration %v.%v\n", typedCount, untypedCount)
-			goGenerate(diffs, untypedRunExp)
-			untypedCount++
+			emitSummary(nil, nil, start)
 
-			// order is significant here... because the computeStale
-			// call does a readPkgs
-			prevDiffs := diffs
-			diffs = computeStale(prevDiffs, true)
-			cmdList(prevDiffs)
+			return
 		}
+	}
 
-		// TODO work out what to do here when gg is being used in conjunction
-		// with gai
-		t := time.Now()
-		vvlogf("pre go install")
-		suc, _ := goInstall(pkgs)
-		vvlogf("post go install %v", time.Now().Sub(t))
+	if *fDryRun {
+		printPlan(pkgs, stale)
+		return
+	}
+
+	defer startRun()()
+
+	generate(pkgs, stale)
+}
+
+// loadPkgs (re)populates pkgInfo with the packages matched by args, less any
+// excluded via -X, and returns their import paths
+func loadPkgs(args []string) []string {
+	pkgInfo = make(map[string]*Package)
+
+	readPkgs(args, true)
+
+	pkgs := make([]string, 0, len(pkgInfo))
+	for k := range pkgInfo {
+		pkgs = append(pkgs, k)
+	}
+
+	sort.Strings(pkgs)
+
+	for _, p := range pkgs {
+		emit(event{Action: evLoad, Package: p, Dir: pkgInfo[p].Dir})
+	}
+
+	return pkgs
+}
+
+// generate runs the phases of the pipeline (see pipeline) to a fixpoint.
+// dirPkgs is the set of packages that contain directives. stale is the set
+// of packages (not necessarily with directives) that have changed; only
+// packages in dirPkgs that are in, or depend on a package in, stale are
+// considered. pkgDeps must be current
+func generate(dirPkgs, stale []string) {
+	isDir := make(map[string]struct{}, len(dirPkgs))
+	for _, p := range dirPkgs {
+		isDir[p] = struct{}{}
+	}
 
-		if len(suc) == 0 {
-			fatalf("No packages from %v succeeded install; cannot continue\n", pkgs)
+	// packages without directives are recorded in the cache too, so that
+	// later runs see changes to them (see cacheStale)
+	var plain []string
+	for p := range pkgInfo {
+		if _, ok := isDir[p]; !ok {
+			plain = append(plain, p)
 		}
+	}
+
+	// a package needs its compiled phases re-run if any of its
+	// dependencies is stale, even if the package itself is not
+	pkgs := dependents(stale, dirPkgs)
+
+	isStale := make(map[string]struct{}, len(pkgs))
+	for _, p := range pkgs {
+		isStale[p] = struct{}{}
+	}
+
+	for _, p := range dirPkgs {
+		_, ok := isStale[p]
+		emit(event{Action: evStale, Package: p, Hash: pkgInfo[p].pkgHash, Stale: boolPtr(ok)})
+	}
 
-		if typedCount > typedLoopLimit {
-			fatalf("Exceeded loop limit for typed go generate cmd: %v\n", untypedRunExp)
+	start := time.Now()
+
+	if len(pkgs) == 0 {
+		emitSummary(nil, nil, start)
+
+		if !*fCheck {
+			savePkgCache(plain)
 		}
 
-		vvlogf("Typed iteration %v.0\n", typedCount)
-		goGenerate(suc, typedRunExp)
-		typedCount++
+		return
+	}
 
-		// order is significant here... because the computeStale
-		// call does a readPkgs
-		computeStale(suc, true)
-		cmdList(suc)
+	// all is the set of packages we record in the cache at the end of the run;
+	// failed tracks those that did not install on their most recent attempt
+	// (and hence did not have their compiled phases run)
+	all := pkgs
+	failed := make(map[string]struct{})
 
-		postTypedDelta := deltaHash(preUntyped)
+	var hist history
+	hist.record("start", pkgs)
 
-		// if there has been no change then regardless of how many fails etc
-		// we should break
-		if len(postTypedDelta) == 0 {
-			vvlogf("no delta from start of untyped iteration; breaking")
+	phases := pipeline(dirPkgs)
+
+	// changed is the set of packages whose changes the phases of the current
+	// round are to see: those that were stale to begin with or, in later
+	// rounds, were changed by phases of the previous round that the earlier
+	// phases had not seen. It grows as the phases of the round make changes
+	changed := stale
+
+	for round := 1; ; round++ {
+		if round > roundLoopLimit {
+			fatalf("Exceeded loop limit for the phases %v\n%v", phaseNames(phases), hist.report(dependents(changed, dirPkgs)))
+		}
+
+		// rerun is the set of packages changed by phases that must be seen
+		// by phases that have already run in this round
+		var rerun []string
+
+		for i, ph := range phases {
+			if ph.Compiled {
+				pkgs := phasePkgs(ph.Name, dependents(changed, dirPkgs))
+				if len(pkgs) == 0 {
+					continue
+				}
+
+				// TODO work out what to do here when gg is being used in conjunction
+				// with gai
+				t := time.Now()
+				vvlogf("pre go install")
+				suc, fail := goInstall(topoSort(pkgs))
+				vvlogf("post go install %v", time.Now().Sub(t))
+
+				for _, p := range suc {
+					delete(failed, p)
+					emit(event{Action: evInstall, Package: p, Failed: boolPtr(false)})
+				}
+				for _, p := range fail {
+					failed[p] = struct{}{}
+					emit(event{Action: evInstall, Package: p, Failed: boolPtr(true)})
+				}
+
+				if len(suc) == 0 {
+					fatalf("No packages from %v succeeded install; cannot continue\n", pkgs)
+				}
+
+				it := fmt.Sprintf("%v.0", round)
+				delta := runPhase(ph, it, suc, &hist)
+
+				// a compiled phase runs once per round, so its changes
+				// have been seen by none of the phases up to and including
+				// it
+				changed = union(changed, delta)
+				rerun = union(rerun, delta)
+
+				continue
+			}
+
+			diffs := phasePkgs(ph.Name, intersect(changed, dirPkgs))
+
+			for count := 1; len(diffs) > 0; count++ {
+				if count > phaseLoopLimit {
+					fatalf("Exceeded loop limit for %v generators\n%v", ph.Name, hist.report(diffs))
+				}
+
+				it := fmt.Sprintf("%v.%v", round, count)
+				diffs = runPhase(ph, it, diffs, &hist)
+
+				// the phase runs until it changes nothing further, and so
+				// sees its own changes, as do the phases that follow in this
+				// round; those before it do not
+				changed = union(changed, diffs)
+				if i > 0 {
+					rerun = union(rerun, diffs)
+				}
+			}
+		}
+
+		if len(rerun) == 0 {
+			vvlogf("no changes unseen by earlier phases; breaking")
 			break
 		}
 
-		pkgs = postTypedDelta
+		// generators may have added imports
+		loadDeps()
+
+		changed = rerun
+	}
+
+	var done []string
+	for _, p := range all {
+		if _, ok := failed[p]; !ok {
+			done = append(done, p)
+		}
 	}
-}
 
-func buildGoGenRegex(parts []string) string {
-	escpd := make([]string, len(parts))
+	emitSummary(all, keySlice(failed), start)
 
-	for i := range parts {
-		cmd := filepath.Base(parts[i])
-		escpd[i] = regexp.QuoteMeta(cmd)
+	if !*fCheck {
+		savePkgCache(append(done, plain...))
 	}
+}
+
+// emitSummary emits the summary of a run, begun at start, that generated
+// pkgs, of which failed did not install
+func emitSummary(pkgs, failed []string, start time.Time) {
+	emit(event{
+		Action:         evSummary,
+		Packages:       pkgs,
+		FailedPackages: failed,
+		Elapsed:        time.Since(start).Seconds(),
+	})
+}
+
+// runPhase runs iteration it of phase ph for pkgs, recording the result in
+// hist, and returns the subset of pkgs that changed as a result
+func runPhase(ph *Phase, it string, pkgs []string, hist *history) []string {
+	vvlogf("Phase %v iteration %v\n", ph.Name, it)
+	emit(event{Action: evIteration, Phase: ph.Name, Iteration: it})
+
+	t := time.Now()
+	goGenerate(ph.Name, it, topoSort(pkgs))
+	times.since(timePhase, ph.Name, t)
+	times.since(timeIteration, ph.Name+" "+it, t)
+
+	// order is significant here... because the computeStale
+	// call does a readPkgs
+	delta := computeStale(pkgs, true)
+	hist.record(ph.Name+" "+it, pkgs)
+	cmdList(pkgs, true)
+
+	return delta
+}
+
+// goGenerate runs, as iteration it, the directives for the generators of
+// phase, per the config in force for each package, in each of pkgs. Batch
+// generators run first (see generateBatches); the remaining directives run
+// with packages running in parallel where the import graph allows. Within a package
+// directives run in the order go generate would run them, subject to the
+// ordering constraints of the config (see Config.order), stopping at the
+// first failure. The output from each package is buffered and printed as a
+// whole once that package completes so that output from different packages
+// is not interleaved (with -json the output is instead included in the
+// events)
+func goGenerate(phase, it string, pkgs []string) {
+	generateBatches(phase, it, pkgs)
+
+	var outLock sync.Mutex
+
+	err := runPkgs(pkgs, func(pkg string) error {
+		emit(event{Action: evGenerateStart, Package: pkg, Phase: phase})
+
+		t := time.Now()
+		out := new(bytes.Buffer)
+
+		err := generatePkg(phase, it, pkg, out)
+
+		times.since(timePackage, pkg, t)
+
+		ev := event{
+			Action:  evGenerateEnd,
+			Package: pkg,
+			Phase:   phase,
+			Elapsed: time.Since(t).Seconds(),
+			Output:  out.String(),
+		}
+		if err != nil {
+			ev.Error = err.Error()
+		}
+		emit(ev)
 
-	exp := fmt.Sprintf(gogenerate.GoGeneratePrefix+" (?:%v)(?:$| )", strings.Join(escpd, "|"))
+		if err != nil {
+			return fmt.Errorf("%v\n%s", err, out.Bytes())
+		}
+
+		if out.Len() > 0 && !*fJSON {
+			// we always log the output from generators
+			outLock.Lock()
+			fmt.Print(out.String())
+			outLock.Unlock()
+		}
+
+		return nil
+	})
 
-	// aggressively ensure the regexp compiles here... else a call to go generate
-	// will be useless
-	_, err := regexp.Compile(exp)
 	if err != nil {
-		fatalf("Could not form valid go generate command: %v\n", err)
+		fatalf("%v", err)
 	}
-
-	return exp
 }
 
-func goGenerate(pkgs []string, runExp string) {
-	args := []string{"generate"}
+func generatePkg(phase, it string, pkg string, out io.Writer) (err error) {
+	c := pkgConfig(pkg)
+	cmds := c.cmds(phase)
 
-	if *fVerbose {
-		args = append(args, "-v")
+	dirs, err := pkgDirectives(pkg)
+	if err != nil {
+		return err
 	}
 
-	if *fExecute {
-		args = append(args, "-x")
+	dirs = c.order(dirs)
+
+	m := loadManifest(pkgInfo[pkg].Dir)
+
+	defer func() {
+		if *fCheck {
+			return
+		}
+
+		if serr := m.save(); serr != nil && err == nil {
+			err = fmt.Errorf("could not save manifest for %v: %v", pkg, serr)
+		}
+	}()
+
+	lastFile := ""
+
+	for _, d := range dirs {
+		if _, ok := cmds[d.cmd()]; !ok || d.generator().Batch {
+			continue
+		}
+
+		if *fVerbose && d.file != lastFile {
+			fmt.Fprintln(out, relPath(d.file))
+			lastFile = d.file
+		}
+
+		if *fExecute {
+			fmt.Fprintln(out, strings.Join(d.args, " "))
+		}
+
+		emit(event{Action: evDirectiveStart, Package: pkg, Phase: phase, File: d.file, Line: d.line, Args: d.args})
+
+		t := time.Now()
+		dout := new(bytes.Buffer)
+
+		cached, err := runDirective(phase, it, d, m, dout)
+
+		times.since(timeGenerator, d.cmd(), t)
+
+		ev := event{
+			Action:   evDirectiveEnd,
+			Package:  pkg,
+			Phase:    phase,
+			File:     d.file,
+			Line:     d.line,
+			Args:     d.args,
+			Elapsed:  time.Since(t).Seconds(),
+			ExitCode: intPtr(exitCode(err)),
+			Cached:   boolPtr(cached),
+			Output:   dout.String(),
+		}
+		if err != nil {
+			ev.Error = err.Error()
+		}
+		emit(ev)
+
+		out.Write(dout.Bytes())
+
+		if err != nil {
+			return err
+		}
 	}
 
-	args = append(args, "-run", runExp)
-	args = append(args, pkgs...)
+	return nil
+}
 
-	xlogf("go %v", strings.Join(args, " "))
+// runDirective runs d in iteration it of phase, or restores its effect from
+// the directive cache, recording the files it owns in m. The boolean result
+// indicates whether the effect was restored from the cache
+func runDirective(phase, it string, d directive, m *manifest, out *bytes.Buffer) (bool, error) {
+	dir := filepath.Dir(d.file)
 
-	out, err := exec.Command("go", args...).CombinedOutput()
+	before, err := dirHashes(dir)
 	if err != nil {
-		fatalf("go generate: %v\n%s", err, out)
+		return false, fmt.Errorf("%v: could not hash directory: %v", d.pos(), err)
 	}
 
-	if len(out) > 0 {
-		// we always log the output from go generate
-		fmt.Print(string(out))
+	beforeMod, err := dirModTimes(dir)
+	if err != nil {
+		return false, fmt.Errorf("%v: could not read directory: %v", d.pos(), err)
 	}
-}
 
-func goInstall(pkgs []string) ([]string, []string) {
-	fmap := make(map[string]struct{})
+	key, cacheable := d.cacheKey(phase, before)
 
-	xlogf("gai %v", strings.Join(pkgs, " "))
-	vvlogf("gai %v", strings.Join(pkgs, " "))
+	cached := false
 
-	out, err := exec.Command("gai", pkgs...).CombinedOutput()
-	if err != nil {
-		sc := bufio.NewScanner(bytes.NewBuffer(out))
-		for sc.Scan() {
-			line := sc.Text()
+	if cacheable && !*fForce {
+		cached, err = restoreDirCache(key, dir, out)
+		if err != nil {
+			return false, fmt.Errorf("%v: could not restore cached output: %v", d.pos(), err)
+		}
+	}
 
-			if strings.HasPrefix(line, "# ") {
-				parts := strings.Fields(line)
+	if !cached {
+		// a generator killed for exceeding a timeout may have left files
+		// half written, so where a timeout is in force we snapshot the
+		// directory in order to undo its changes. Only the directory of
+		// the package is restored: those into which the directive writes
+		// via outpkg: flags may belong to packages being generated
+		// concurrently. The changes of a generator stopped by an interrupt
+		// alone are not undone, but are reported (see leftChanges)
+		var snap *snapshot
+
+		if d.generator().timeout > 0 || *fTimeout > 0 {
+			snap, err = takeSnapshot([]string{dir})
+			if err != nil {
+				return false, fmt.Errorf("%v: %v", d.pos(), err)
+			}
+		}
 
-				if len(parts) != 2 {
-					fatalf("could not parse go install output\n%v", string(out))
+		if err := d.run(phase, it, out); err != nil {
+			var ke *killedError
+			if errors.As(err, &ke) {
+				left := leftChanges(map[string]map[string]string{dir: before})
+				if snap != nil {
+					left = undo(snap)
 				}
 
-				fmap[parts[1]] = struct{}{}
+				return false, fmt.Errorf("%v: running %q: %w%v", d.pos(), d.args[0], err, left)
 			}
-		}
 
-		if err := sc.Err(); err != nil {
-			fatalf("could not parse go install output\n%v", string(out))
+			return false, fmt.Errorf("%v: running %q: %w", d.pos(), d.args[0], err)
 		}
 	}
 
-	if len(out) > 0 {
-		xlog(string(out))
+	after, err := dirHashes(dir)
+	if err != nil {
+		return cached, fmt.Errorf("%v: could not hash directory: %v", d.pos(), err)
 	}
 
-	var f, s []string
+	afterMod, err := dirModTimes(dir)
+	if err != nil {
+		return cached, fmt.Errorf("%v: could not read directory: %v", d.pos(), err)
+	}
 
-	for _, p := range pkgs {
-		if _, ok := fmap[p]; ok {
-			f = append(f, p)
-		} else {
-			s = append(s, p)
+	if err := checkOutputs(d.generator(), before, after, beforeMod, afterMod); err != nil {
+		return cached, fmt.Errorf("%v: %v", d.pos(), err)
+	}
+
+	if !cached && cacheable {
+		if err := saveDirCache(key, dir, before, after, out.String()); err != nil {
+			return false, fmt.Errorf("%v: could not cache output: %v", d.pos(), err)
 		}
 	}
 
-	return s, f
+	m.record(d, before, after, beforeMod, afterMod)
+
+	return cached, nil
 }
 
 // cmdList returns a subset of packages (subset of pNames) that contain directives
 // and a map[package] -> map[cmd]struct{} of which commands are used in which packages
 // As it scans each package in pNames it removes any generated files that do not have
 // an occurence of a directive for the associated generator in the package (not test
-// aware right now). In the process it also validates the directives that are present
-func cmdList(pNames []string) []string {
+// aware right now). In the process it also validates the directives that are present.
+// If remove is false the orphaned files are left in place, as is the manifest,
+// which is also left in place with -n and -check
+func cmdList(pNames []string, remove bool) []string {
 	cmds := make(map[string]map[string]struct{})
 
 	for _, pName := range pNames {
 		var h map[string]struct{}
 
 		pkg := pkgInfo[pName]
+		c := pkgConfig(pName)
 
-		var goFiles []string
-		goFiles = append(goFiles, pkg.GoFiles...)
-		goFiles = append(goFiles, pkg.CgoFiles...)
-		goFiles = append(goFiles, pkg.TestGoFiles...)
-		goFiles = append(goFiles, pkg.XTestGoFiles...)
+		dirs, err := pkgDirectives(pName)
+		if err != nil {
+			fatalf("could not read directives in %v: %v", pName, err)
+		}
 
-		cmdFiles := make(map[string][]string)
+		for _, d := range dirs {
+			if *fList {
+				fmt.Println(d)
+			}
 
-		for _, f := range goFiles {
-			f = filepath.Join(pkg.Dir, f)
+			if c.phase(d.cmd()) == "" {
+				fatalf("%v: go generate directive command \"%v\" is not a configured generator (config: %v)", d.pos(), d.cmd(), c.describe())
+			}
 
-			visitDir := func(line int, dirArgs []string) error {
-				if *fList {
-					rel, err := filepath.Rel(wd, f)
-					if err != nil {
-						fatalf("could not create filepath.Re(%q, %q): %q", wd, f, err)
-					}
-					fmt.Printf("%v:%v: %v\n", rel, line, strings.Join(dirArgs, " "))
-				}
-				if h == nil {
-					h = make(map[string]struct{})
-					cmds[pName] = h
-				}
+			if g := d.generator(); !g.WriteOutside && len(d.outPkgs()) > 0 {
+				fatalf("%v: uses an outpkg: flag but %v is not permitted to write outside its package (see WriteOutside)", d.pos(), d.cmd())
+			}
+
+			if h == nil {
+				h = make(map[string]struct{})
+				cmds[pName] = h
+			}
 
-				h[dirArgs[0]] = struct{}{}
+			h[d.cmd()] = struct{}{}
+		}
+
+		if !remove {
+			continue
+		}
 
-				return nil
+		// files owned by directives that no longer exist (see manifest) are
+		// orphans regardless of their names
+		m := loadManifest(pkg.Dir)
+
+		orphans := m.orphans(dirs)
+
+		// the changes made by -check are undone (see run), which must
+		// include the pruning of the manifest
+		if !*fDryRun && !*fCheck {
+			if err := m.save(); err != nil {
+				fatalf("could not save manifest for %v: %v", pName, err)
 			}
+		}
+
+		// otherwise we fall back to file naming: generated files for commands
+		// that have no directive in the package are orphans
+		for _, fn := range pkg.goFiles() {
+			f := filepath.Join(pkg.Dir, fn)
 
 			if cmd, ok := gogenerate.FileIsGenerated(f); ok {
 				// we only care about cmds which we know about in our config
 				// for now this helps to deal with the edge case that is protobuf
 				// files
 
-				_, oktyp := config.typedCmds[cmd]
-				_, okuntyp := config.untypedCmds[cmd]
+				_, used := h[cmd]
 
-				if oktyp || okuntyp {
-					cmdFiles[cmd] = append(cmdFiles[cmd], f)
+				if c.phase(cmd) != "" && !used {
+					orphans = append(orphans, f)
 				}
 			}
-
-			gogenerate.DirFunc(pName, pkg.Dir, f, visitDir)
 		}
 
 		removed := false
+		seen := make(map[string]struct{})
 
-		for c, fs := range cmdFiles {
-			if _, ok := h[c]; !ok {
-				for _, f := range fs {
-					vvlogf("removing %v", f)
+		for _, f := range orphans {
+			if _, ok := seen[f]; ok {
+				continue
+			}
 
-					removed = true
+			seen[f] = struct{}{}
 
-					err := os.Remove(f)
-					if err != nil {
-						fatalf("could not remove %v: %v", f, err)
-					}
-				}
+			if *fDryRun {
+				fmt.Printf("rm %v\n", relPath(f))
+				continue
 			}
-		}
-
-		if removed {
-			readPkgs([]string{pName}, false)
-		}
-	}
 
-	cm := cmdMap(cmds)
+			vvlogf("removing %v", f)
+			emit(event{Action: evRemove, Package: pName, File: f})
 
-	for v := range cm {
+			removed = true
 
-		_, tok := config.typedCmds[v]
-		_, uok := config.untypedCmds[v]
+			err := os.Remove(f)
+			if err != nil {
+				fatalf("could not remove %v: %v", f, err)
+			}
+		}
 
-		if !tok && !uok {
-			log.Fatalf("go generate directive command \"%v\" is not specified as either typed or untyped", v)
+		if removed {
+			readPkgs([]string{pName}, false)
 		}
 	}
 
@@ -351,7 +736,7 @@ func xlog(args ...interface{}) {
 
 func xlogf(format string, args ...interface{}) {
 	if *fVVerbose || *fExecute {
-		log.Print(args...)
+		log.Printf(format, args...)
 	}
 }
 
@@ -361,23 +746,48 @@ func vvlogf(format string, args ...interface{}) {
 	}
 }
 
-func cmdMap(cmds map[string]map[string]struct{}) map[string]struct{} {
-	allCmds := make(map[string]struct{})
+func keySlice(m map[string]struct{}) []string {
+	res := make([]string, 0, len(m))
+
+	for k := range m {
+		res = append(res, k)
+	}
+
+	return res
+}
+
+// union returns the elements of a followed by those of b not in a
+func union(a, b []string) []string {
+	in := make(map[string]struct{}, len(a))
+	for _, v := range a {
+		in[v] = struct{}{}
+	}
 
-	for _, m := range cmds {
-		for k := range m {
-			allCmds[k] = struct{}{}
+	res := append([]string(nil), a...)
+
+	for _, v := range b {
+		if _, ok := in[v]; !ok {
+			in[v] = struct{}{}
+			res = append(res, v)
 		}
 	}
 
-	return allCmds
+	return res
 }
 
-func keySlice(m map[string]struct{}) []string {
-	res := make([]string, 0, len(m))
+// intersect returns the elements of a that are also in b
+func intersect(a, b []string) []string {
+	in := make(map[string]struct{}, len(b))
+	for _, v := range b {
+		in[v] = struct{}{}
+	}
 
-	for k := range m {
-		res = append(res, k)
+	var res []string
+
+	for _, v := range a {
+		if _, ok := in[v]; ok {
+			res = append(res, v)
+		}
 	}
 
 	return res
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"myitcv.io/gogenerate"
+)
+
+// graphNode is a node in the generation graph. Kind is one of package,
+// directive, generator or file
+type graphNode struct {
+	ID    string
+	Kind  string
+	Label string
+	Phase string `json:",omitempty"`
+}
+
+// graphEdge is a directed edge in the generation graph. Kind is one of:
+//
+//	directive  package -> a directive it contains
+//	runs       directive -> the generator it runs
+//	generates  generator -> a file it generated
+//	outpkg     directive -> a package named by an outpkg: flag
+//	depends    package -> a package with directives on which it depends
+//
+// depends edges are transitive, and include dependencies via tests, because
+// that is how gg decides which packages to regenerate when a package changes
+type graphEdge struct {
+	From string
+	To   string
+	Kind string
+}
+
+type genGraph struct {
+	Nodes []*graphNode
+	Edges []graphEdge
+
+	nodes map[string]*graphNode
+	edges map[graphEdge]struct{}
+}
+
+// node adds the node identified by kind and name, if it does not already
+// exist, returning its ID. label defaults to name
+func (g *genGraph) node(kind, name, label, phase string) string {
+	id := kind + ":" + name
+
+	if label == "" {
+		label = name
+	}
+
+	if _, ok := g.nodes[id]; !ok {
+		n := &graphNode{ID: id, Kind: kind, Label: label, Phase: phase}
+		g.nodes[id] = n
+		g.Nodes = append(g.Nodes, n)
+	}
+
+	return id
+}
+
+func (g *genGraph) edge(from, to, kind string) {
+	e := graphEdge{From: from, To: to, Kind: kind}
+
+	if _, ok := g.edges[e]; !ok {
+		g.edges[e] = struct{}{}
+		g.Edges = append(g.Edges, e)
+	}
+}
+
+// graph implements gg graph
+func graph(args []string) {
+	switch *fGraphFormat {
+	case "text", "dot", "json":
+	default:
+		fatalf("unknown graph format %q; must be one of text, dot, json", *fGraphFormat)
+	}
+
+	loadConfig()
+
+	pkgs := cmdList(loadPkgs(args), false)
+	sort.Strings(pkgs)
+
+	loadDeps()
+
+	g := buildGraph(pkgs)
+
+	switch *fGraphFormat {
+	case "text":
+		for _, e := range g.Edges {
+			fmt.Printf("%v %v %v\n", e.From, e.Kind, e.To)
+		}
+	case "dot":
+		g.writeDot()
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "\t")
+
+		if err := enc.Encode(g); err != nil {
+			fatalf("could not write graph: %v", err)
+		}
+	}
+}
+
+// buildGraph returns the generation graph for pkgs, the packages that
+// contain directives. The files each directive generated are taken from its
+// manifest entry, falling back to the files named as generated by its
+// generator
+func buildGraph(pkgs []string) *genGraph {
+	g := &genGraph{
+		nodes: make(map[string]*graphNode),
+		edges: make(map[graphEdge]struct{}),
+	}
+
+	in := make(map[string]struct{}, len(pkgs))
+	for _, p := range pkgs {
+		in[p] = struct{}{}
+	}
+
+	for _, p := range pkgs {
+		pkg := pkgInfo[p]
+		pn := g.node("package", p, "", "")
+
+		dirs, err := pkgDirectives(p)
+		if err != nil {
+			fatalf("could not read directives in %v: %v", p, err)
+		}
+
+		m := loadManifest(pkg.Dir)
+		files := readDirFiles(pkg.Dir)
+
+		for _, d := range dirs {
+			phase := pkgConfig(p).phase(d.cmd())
+
+			dn := g.node("directive", d.pos(), d.String(), phase)
+			gn := g.node("generator", d.cmd(), "", phase)
+
+			g.edge(pn, dn, "directive")
+			g.edge(dn, gn, "runs")
+
+			var outs []string
+
+			for _, e := range m.Directives {
+				if e.is(d) {
+					for _, o := range e.Outputs {
+						outs = append(outs, filepath.Join(pkg.Dir, o))
+					}
+				}
+			}
+
+			if len(outs) == 0 {
+				for f := range files {
+					if gogenerate.FileGeneratedBy(f, d.cmd()) {
+						outs = append(outs, f)
+					}
+				}
+			}
+
+			sort.Strings(outs)
+
+			for _, f := range outs {
+				g.edge(gn, g.node("file", relPath(f), "", ""), "generates")
+			}
+
+			for _, o := range d.outPkgs() {
+				g.edge(dn, g.node("package", o, "", ""), "outpkg")
+			}
+		}
+
+		var deps []string
+		for d := range pkgDeps[p] {
+			if _, ok := in[d]; ok {
+				deps = append(deps, d)
+			}
+		}
+
+		sort.Strings(deps)
+
+		for _, d := range deps {
+			g.edge(pn, g.node("package", d, "", ""), "depends")
+		}
+	}
+
+	return g
+}
+
+var dotShapes = map[string]string{
+	"package":   "box",
+	"directive": "note",
+	"generator": "ellipse",
+	"file":      "plaintext",
+}
+
+func (g *genGraph) writeDot() {
+	fmt.Printf("digraph gg {\n")
+
+	for _, n := range g.Nodes {
+		label := n.Label
+		if n.Phase != "" {
+			label += "\n(" + n.Phase + ")"
+		}
+
+		fmt.Printf("\t%v [label=%v shape=%v];\n", dotQuote(n.ID), dotQuote(label), dotShapes[n.Kind])
+	}
+
+	for _, e := range g.Edges {
+		style := ""
+		if e.Kind == "depends" || e.Kind == "outpkg" {
+			style = " style=dashed"
+		}
+
+		fmt.Printf("\t%v -> %v [label=%v%v];\n", dotQuote(e.From), dotQuote(e.To), dotQuote(e.Kind), style)
+	}
+
+	fmt.Printf("}\n")
+}
+
+var dotEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func dotQuote(s string) string {
+	return `"` + dotEscaper.Replace(s) + `"`
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// pkgState is the state of a package as of the end of an iteration
+type pkgState struct {
+	hash string
+
+	// files maps the name of each Go file in the package to a hash of its
+	// contents
+	files map[string]string
+
+	// changed is the set of files that differ from the previous state of
+	// the package
+	changed map[string]struct{}
+
+	// contents maps the name of a Go file to its contents, which we keep
+	// only for the files that differ from the previous or next state of the
+	// package (those that report can show), and for every file in the latest
+	// state, which has no next state yet
+	contents map[string][]byte
+}
+
+type iteration struct {
+	label string
+	pkgs  map[string]*pkgState
+}
+
+// history records the state of the packages touched by each iteration of
+// generate, so that a failure to converge can be explained in terms of the
+// packages and files that keep changing
+type history struct {
+	its []iteration
+
+	// last is the latest recorded state of each package
+	last map[string]*pkgState
+}
+
+// record adds an iteration with the given label, capturing the current state
+// of pkgs. pkgHash must be current for each package
+func (h *history) record(label string, pkgs []string) {
+	if h.last == nil {
+		h.last = make(map[string]*pkgState)
+	}
+
+	it := iteration{
+		label: label,
+		pkgs:  make(map[string]*pkgState, len(pkgs)),
+	}
+
+	for _, p := range pkgs {
+		pkg := pkgInfo[p]
+		prev := h.last[p]
+
+		s := &pkgState{
+			hash:     pkg.pkgHash,
+			files:    make(map[string]string),
+			changed:  make(map[string]struct{}),
+			contents: make(map[string][]byte),
+		}
+
+		if prev != nil && prev.hash == s.hash {
+			for f, fh := range prev.files {
+				s.files[f] = fh
+				s.contents[f] = prev.contents[f]
+			}
+		} else {
+			for _, f := range pkg.goFiles() {
+				b, err := ioutil.ReadFile(filepath.Join(pkg.Dir, f))
+				if err != nil {
+					fatalf("could not read %v: %v", f, err)
+				}
+
+				s.files[f] = fmt.Sprintf("%x", sha1.Sum(b))
+				s.contents[f] = b
+			}
+		}
+
+		if prev != nil {
+			for f, fh := range s.files {
+				if prev.files[f] != fh {
+					s.changed[f] = struct{}{}
+				}
+			}
+
+			prev.trim(s)
+		}
+
+		h.last[p] = s
+		it.pkgs[p] = s
+	}
+
+	h.its = append(h.its, it)
+}
+
+// trim drops the contents of the files in s that are the same in next, the
+// state that follows s, other than those that changed in s
+func (s *pkgState) trim(next *pkgState) {
+	for f := range s.contents {
+		if _, ok := s.changed[f]; !ok && next.files[f] == s.files[f] {
+			delete(s.contents, f)
+		}
+	}
+}
+
+// report explains, for each of pkgs, how its state has changed over the
+// recorded iterations: whether it has returned to an earlier state (a cycle)
+// or has been different in every iteration (churn), which files differ
+// between its last two states and how
+func (h *history) report(pkgs []string) string {
+	buf := new(bytes.Buffer)
+
+	sorted := append([]string(nil), pkgs...)
+	sort.Strings(sorted)
+
+	for _, p := range sorted {
+		var states []*pkgState
+		var labels []string
+
+		for _, it := range h.its {
+			if s, ok := it.pkgs[p]; ok {
+				states = append(states, s)
+				labels = append(labels, it.label)
+			}
+		}
+
+		n := len(states)
+
+		if n < 2 || states[n-1].hash == states[n-2].hash {
+			continue
+		}
+
+		hashes := make([]string, n)
+		for i, s := range states {
+			hashes[i] = fmt.Sprintf("%v:%.7s", labels[i], s.hash)
+		}
+
+		repeat := -1
+		for j := n - 3; j >= 0; j-- {
+			if states[j].hash == states[n-1].hash {
+				repeat = j
+				break
+			}
+		}
+
+		if repeat >= 0 {
+			fmt.Fprintf(buf, "%v cycles with period %v (state at iteration %v repeats that at %v)\n", p, n-1-repeat, labels[n-1], labels[repeat])
+		} else {
+			fmt.Fprintf(buf, "%v changed in every iteration without repeating a state\n", p)
+		}
+
+		fmt.Fprintf(buf, "\thashes: %v\n", strings.Join(hashes, " "))
+
+		prev, last := states[n-2], states[n-1]
+
+		for _, f := range changedFiles(prev.files, last.files) {
+			fmt.Fprintf(buf, "\t%v changed between iterations %v and %v:\n", f, labels[n-2], labels[n-1])
+			buf.WriteString(lineDiff(prev.contents[f], last.contents[f], "\t\t"))
+		}
+	}
+
+	return buf.String()
+}
+
+// changedFiles returns the names of the files that differ between a and b,
+// which map file names to hashes
+func changedFiles(a, b map[string]string) []string {
+	var res []string
+
+	for f, ah := range a {
+		if bh, ok := b[f]; !ok || ah != bh {
+			res = append(res, f)
+		}
+	}
+
+	for f := range b {
+		if _, ok := a[f]; !ok {
+			res = append(res, f)
+		}
+	}
+
+	sort.Strings(res)
+
+	return res
+}
+
+// lineDiff returns a minimal description of the difference between a and b:
+// the common leading and trailing lines are elided and the differing region
+// is shown as removed (-) and added (+) lines. Each line of the result is
+// prefixed with indent
+func lineDiff(a, b []byte, indent string) string {
+	al := strings.SplitAfter(string(a), "\n")
+	bl := strings.SplitAfter(string(b), "\n")
+
+	pre := 0
+	for pre < len(al) && pre < len(bl) && al[pre] == bl[pre] {
+		pre++
+	}
+
+	suf := 0
+	for suf < len(al)-pre && suf < len(bl)-pre && al[len(al)-1-suf] == bl[len(bl)-1-suf] {
+		suf++
+	}
+
+	buf := new(bytes.Buffer)
+
+	fmt.Fprintf(buf, "%v@@ line %v @@\n", indent, pre+1)
+
+	for _, l := range al[pre : len(al)-suf] {
+		fmt.Fprintf(buf, "%v-%v\n", indent, strings.TrimSuffix(l, "\n"))
+	}
+
+	for _, l := range bl[pre : len(bl)-suf] {
+		fmt.Fprintf(buf, "%v+%v\n", indent, strings.TrimSuffix(l, "\n"))
+	}
+
+	return buf.String()
+}
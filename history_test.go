@@ -0,0 +1,44 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHistoryRecord(t *testing.T) {
+	dir := setupCache(t)
+
+	var h history
+
+	srcs := []string{
+		"package a\n\nconst A = 1\n",
+		"package a\n\nconst A = 1\n",
+		"package a\n\nconst A = 2\n",
+		"package a\n\nconst A = 3\n",
+	}
+
+	for i, src := range srcs {
+		writePkg(t, dir, "a", src)
+		hashAll()
+		h.record(string(rune('0'+i)), []string{"ex/a"})
+	}
+
+	// contents are kept where p.go differs from an adjacent state, and for
+	// the latest state
+	want := []bool{false, true, true, true}
+
+	for i, it := range h.its {
+		_, got := it.pkgs["ex/a"].contents["p.go"]
+		if got != want[i] {
+			t.Errorf("iteration %v kept contents: %v; want %v", i, got, want[i])
+		}
+	}
+
+	r := h.report([]string{"ex/a"})
+
+	for _, s := range []string{"changed in every iteration", "-const A = 2", "+const A = 3"} {
+		if !strings.Contains(r, s) {
+			t.Errorf("report does not contain %q:\n%v", s, r)
+		}
+	}
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"myitcv.io/gogenerate"
+)
+
+const manifestDirName = "manifests"
+
+// manifest records, for the directives in a package directory, the files each
+// directive owns: those it created, plus any generated files it has since
+// rewritten. gg uses the manifest to remove the outputs of directives that no
+// longer exist (including where a directive's arguments have changed),
+// whatever those outputs are called
+type manifest struct {
+	Dir        string
+	Directives []*manifestEntry
+}
+
+// manifestEntry identifies a directive by the file that contains it and its
+// expanded arguments; the line number is deliberately not part of the
+// identity so that unrelated edits do not orphan outputs
+type manifestEntry struct {
+	File    string
+	Args    []string
+	Outputs []string
+
+	// Hashes maps each of Outputs to the hash of its contents (see hashFile)
+	// as last written by the directive, so that an output the user has
+	// since edited is not removed as an orphan
+	Hashes map[string]string `json:",omitempty"`
+}
+
+func (e *manifestEntry) is(d directive) bool {
+	if e.File != filepath.Base(d.file) || len(e.Args) != len(d.args) {
+		return false
+	}
+
+	for i := range e.Args {
+		if e.Args[i] != d.args[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func manifestFile(dir string) string {
+	return filepath.Join(ggCacheDir(), manifestDirName, fmt.Sprintf("%x", sha1.Sum([]byte(dir))))
+}
+
+// loadManifest returns the manifest for dir, which is empty if none has been
+// recorded (or the recorded one cannot be read)
+func loadManifest(dir string) *manifest {
+	m := &manifest{Dir: dir}
+
+	b, err := ioutil.ReadFile(manifestFile(dir))
+	if err != nil {
+		return m
+	}
+
+	if err := json.Unmarshal(b, m); err != nil || m.Dir != dir {
+		vvlogf("ignoring corrupt manifest for %v", dir)
+		return &manifest{Dir: dir}
+	}
+
+	return m
+}
+
+func (m *manifest) save() error {
+	if err := os.MkdirAll(filepath.Join(ggCacheDir(), manifestDirName), 0755); err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(manifestFile(m.Dir), b)
+}
+
+// record updates the entry for d given the state of its directory before and
+// after it ran (see dirHashes and dirModTimes). d owns the files it created,
+// and continues to own files it owned previously if they still exist. It
+// also takes ownership of files it wrote that are named as generated by its
+// command or that match the Outputs declared for its generator; this covers
+// outputs that already existed when the manifest was first recorded. We
+// never take ownership of other files that existed beforehand: a directive
+// that edits a hand-written file does not own it
+func (m *manifest) record(d directive, before, after map[string]string, beforeMod, afterMod map[string]time.Time) {
+	var e *manifestEntry
+
+	g := d.generator()
+
+	for _, me := range m.Directives {
+		if me.is(d) {
+			e = me
+			break
+		}
+	}
+
+	if e == nil {
+		e = &manifestEntry{File: filepath.Base(d.file), Args: d.args}
+		m.Directives = append(m.Directives, e)
+	}
+
+	// owned maps each file d owns to its hash as d last wrote it
+	owned := make(map[string]string)
+
+	for _, o := range e.Outputs {
+		if _, ok := after[o]; ok {
+			owned[o] = e.Hashes[o]
+		}
+	}
+
+	for n, h := range after {
+		bh, existed := before[n]
+
+		if !existed {
+			owned[n] = h
+			continue
+		}
+
+		written := bh != h || !beforeMod[n].Equal(afterMod[n])
+
+		if !written {
+			continue
+		}
+
+		if _, ok := owned[n]; ok || gogenerate.FileGeneratedBy(n, d.cmd()) || g.isOutput(n) {
+			owned[n] = h
+		}
+	}
+
+	e.Outputs = make([]string, 0, len(owned))
+	e.Hashes = make(map[string]string, len(owned))
+
+	for o, h := range owned {
+		e.Outputs = append(e.Outputs, o)
+
+		if h != "" {
+			e.Hashes[o] = h
+		}
+	}
+
+	sort.Strings(e.Outputs)
+
+	if *fCheck {
+		checkOwnersLock.Lock()
+		for _, o := range e.Outputs {
+			checkOwners[filepath.Join(m.Dir, o)] = d
+		}
+		checkOwnersLock.Unlock()
+	}
+}
+
+var (
+	// checkOwners records, with -check, the directive that owns each file
+	// (keyed by absolute path) per the manifests as updated during the run,
+	// which are not saved, so that reportCheck can say which directive
+	// caused a change
+	checkOwners     = make(map[string]directive)
+	checkOwnersLock sync.Mutex
+)
+
+// orphans prunes m (see prune), returning the paths of the files owned by
+// the directives removed that still exist and that can be removed: those
+// the user has not edited since they were generated. A file that is left is
+// no longer owned by any directive
+func (m *manifest) orphans(dirs []directive) []string {
+	hashes := m.hashes()
+
+	var res []string
+
+	for _, o := range m.prune(dirs) {
+		f := filepath.Join(m.Dir, o)
+
+		if _, err := os.Stat(f); err != nil {
+			continue
+		}
+
+		if h := hashes[o]; h == "" {
+			log.Printf("not removing %v: cannot tell whether it has been edited since it was generated", relPath(f))
+			continue
+		} else if !unedited(f, h) {
+			log.Printf("not removing %v: it has been edited since it was generated", relPath(f))
+			continue
+		}
+
+		res = append(res, f)
+	}
+
+	return res
+}
+
+// hashes returns the hash of each file owned by a directive, as the
+// directive last wrote it, keyed by name. Files whose hash is not known (they
+// were recorded before hashes were) are omitted
+func (m *manifest) hashes() map[string]string {
+	res := make(map[string]string)
+
+	for _, e := range m.Directives {
+		for o, h := range e.Hashes {
+			res[o] = h
+		}
+	}
+
+	return res
+}
+
+// unedited returns whether the file fn still has the hash want, i.e. is as
+// the directive that owns it wrote it, and so may be removed
+func unedited(fn, want string) bool {
+	h, err := hashFile(fn)
+
+	return err == nil && h == want
+}
+
+// owner returns the entry for the directive that owns the file name, or nil
+// if there is none
+func (m *manifest) owner(name string) *manifestEntry {
+	for _, e := range m.Directives {
+		for _, o := range e.Outputs {
+			if o == name {
+				return e
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkOutputs returns an error if g declares Outputs and, going by the state
+// of a directory before and after g ran, g created, wrote or removed a file
+// that does not match them
+func checkOutputs(g *Generator, before, after map[string]string, beforeMod, afterMod map[string]time.Time) error {
+	if len(g.Outputs) == 0 {
+		return nil
+	}
+
+	var bad []string
+
+	for n, h := range after {
+		bh, existed := before[n]
+
+		if (!existed || bh != h || !beforeMod[n].Equal(afterMod[n])) && !g.isOutput(n) {
+			bad = append(bad, n)
+		}
+	}
+
+	for n := range before {
+		if _, ok := after[n]; !ok && !g.isOutput(n) {
+			bad = append(bad, n)
+		}
+	}
+
+	if len(bad) == 0 {
+		return nil
+	}
+
+	sort.Strings(bad)
+
+	return fmt.Errorf("%v wrote files that do not match its Outputs %v: %v", g.cmd(), g.Outputs, strings.Join(bad, ", "))
+}
+
+// prune removes the entries for directives not in dirs, returning the names
+// of the files they owned that are not also owned by a directive in dirs.
+// Before removing such a file, callers must check that it is as the
+// directive wrote it (see unedited)
+func (m *manifest) prune(dirs []directive) []string {
+	var keep, drop []*manifestEntry
+
+Entries:
+	for _, e := range m.Directives {
+		for _, d := range dirs {
+			if e.is(d) {
+				keep = append(keep, e)
+				continue Entries
+			}
+		}
+
+		drop = append(drop, e)
+	}
+
+	kept := make(map[string]struct{})
+	for _, e := range keep {
+		for _, o := range e.Outputs {
+			kept[o] = struct{}{}
+		}
+	}
+
+	orphans := make(map[string]struct{})
+	for _, e := range drop {
+		for _, o := range e.Outputs {
+			if _, ok := kept[o]; !ok {
+				orphans[o] = struct{}{}
+			}
+		}
+	}
+
+	m.Directives = keep
+
+	res := keySlice(orphans)
+	sort.Strings(res)
+
+	return res
+}
+
+// dirModTimes returns the modification time of each regular file in dir,
+// keyed by name
+func dirModTimes(dir string) (map[string]time.Time, error) {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make(map[string]time.Time, len(fis))
+
+	for _, fi := range fis {
+		if fi.Mode().IsRegular() {
+			res[fi.Name()] = fi.ModTime()
+		}
+	}
+
+	return res, nil
+}
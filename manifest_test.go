@@ -0,0 +1,328 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const manifestTestConfig = `{
+	"Root": true,
+	"Untyped": ["ex/gen"],
+	"Generators": [
+		{"Path": "ex/out", "Phase": "untyped", "Outputs": ["*.out"]}
+	]
+}
+`
+
+// setupManifest isolates a test as setupCache does, with a config for the
+// generators gen and out and the package ex/a, which has a directive for
+// each
+func setupManifest(t *testing.T) *Package {
+	t.Helper()
+
+	dir := setupCache(t)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, ConfigFileName), []byte(manifestTestConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	loadConfig()
+
+	return writePkg(t, dir, "a", "package a\n\n//go:generate gen\n//go:generate out -x\n")
+}
+
+func TestManifestRecord(t *testing.T) {
+	t0, t1 := time.Unix(1, 0), time.Unix(2, 0)
+
+	tests := []struct {
+		name string
+		args []string
+
+		// owned are the outputs previously recorded for the directive
+		owned []string
+
+		before, after       map[string]string
+		beforeMod, afterMod map[string]time.Time
+
+		want []string
+	}{
+		{
+			name:   "created",
+			args:   []string{"gen"},
+			before: map[string]string{"p.go": "1"},
+			after:  map[string]string{"p.go": "1", "x.txt": "2"},
+			want:   []string{"x.txt"},
+		},
+		{
+			name:   "hand-written file edited",
+			args:   []string{"gen"},
+			before: map[string]string{"p.go": "1"},
+			after:  map[string]string{"p.go": "2"},
+			want:   []string{},
+		},
+		{
+			name:   "existing generated file rewritten",
+			args:   []string{"gen"},
+			before: map[string]string{"p.go": "1", "gen_p_gen.go": "1"},
+			after:  map[string]string{"p.go": "1", "gen_p_gen.go": "2"},
+			want:   []string{"gen_p_gen.go"},
+		},
+		{
+			name:   "existing generated file of another generator rewritten",
+			args:   []string{"out"},
+			before: map[string]string{"gen_p_gen.go": "1"},
+			after:  map[string]string{"gen_p_gen.go": "2"},
+			want:   []string{},
+		},
+		{
+			name:      "existing output touched",
+			args:      []string{"out", "-x"},
+			before:    map[string]string{"p.go": "1", "x.out": "1"},
+			after:     map[string]string{"p.go": "1", "x.out": "1"},
+			beforeMod: map[string]time.Time{"x.out": t0},
+			afterMod:  map[string]time.Time{"x.out": t1},
+			want:      []string{"x.out"},
+		},
+		{
+			name:   "existing output untouched",
+			args:   []string{"out", "-x"},
+			before: map[string]string{"p.go": "1", "x.out": "1"},
+			after:  map[string]string{"p.go": "1", "x.out": "1"},
+			want:   []string{},
+		},
+		{
+			name:   "owned outputs kept while they exist",
+			args:   []string{"gen"},
+			owned:  []string{"a.txt", "b.txt"},
+			before: map[string]string{"p.go": "1", "a.txt": "1", "b.txt": "1"},
+			after:  map[string]string{"p.go": "1", "a.txt": "1"},
+			want:   []string{"a.txt"},
+		},
+		{
+			name:   "owned output rewritten",
+			args:   []string{"gen"},
+			owned:  []string{"a.txt"},
+			before: map[string]string{"p.go": "1", "a.txt": "1"},
+			after:  map[string]string{"p.go": "1", "a.txt": "2"},
+			want:   []string{"a.txt"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pkg := setupManifest(t)
+
+			d := directive{pkg: pkg.ImportPath, file: filepath.Join(pkg.Dir, "p.go"), args: tt.args}
+
+			m := &manifest{Dir: pkg.Dir}
+			if tt.owned != nil {
+				hashes := make(map[string]string)
+				for _, o := range tt.owned {
+					hashes[o] = tt.before[o]
+				}
+
+				m.Directives = []*manifestEntry{{File: "p.go", Args: tt.args, Outputs: tt.owned, Hashes: hashes}}
+			}
+
+			m.record(d, tt.before, tt.after, tt.beforeMod, tt.afterMod)
+
+			if len(m.Directives) != 1 {
+				t.Fatalf("got %v entries; want 1", len(m.Directives))
+			}
+
+			if got := m.Directives[0].Outputs; !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Outputs = %v; want %v", got, tt.want)
+			}
+
+			for _, o := range tt.want {
+				if got, want := m.Directives[0].Hashes[o], tt.after[o]; got != want {
+					t.Errorf("Hashes[%v] = %q; want %q", o, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestManifestPrune(t *testing.T) {
+	entries := func() []*manifestEntry {
+		return []*manifestEntry{
+			{File: "p.go", Args: []string{"gen"}, Outputs: []string{"gen_p_gen.go", "shared.txt"}},
+			{File: "p.go", Args: []string{"out", "-x"}, Outputs: []string{"shared.txt", "x.out"}},
+		}
+	}
+
+	tests := []struct {
+		name string
+		dirs [][]string
+
+		want []string
+		kept int
+	}{
+		{
+			name: "all present",
+			dirs: [][]string{{"gen"}, {"out", "-x"}},
+			want: []string{},
+			kept: 2,
+		},
+		{
+			name: "shared output kept",
+			dirs: [][]string{{"gen"}},
+			want: []string{"x.out"},
+			kept: 1,
+		},
+		{
+			name: "arguments changed",
+			dirs: [][]string{{"gen"}, {"out", "-y"}},
+			want: []string{"x.out"},
+			kept: 1,
+		},
+		{
+			name: "none present",
+			dirs: nil,
+			want: []string{"gen_p_gen.go", "shared.txt", "x.out"},
+			kept: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &manifest{Dir: "/x", Directives: entries()}
+
+			var dirs []directive
+			for i, a := range tt.dirs {
+				// line numbers are not part of the identity of a directive
+				dirs = append(dirs, directive{file: "/x/p.go", line: 10 + i, args: a})
+			}
+
+			if got := m.prune(dirs); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("prune() = %v; want %v", got, tt.want)
+			}
+
+			if len(m.Directives) != tt.kept {
+				t.Errorf("kept %v entries; want %v", len(m.Directives), tt.kept)
+			}
+		})
+	}
+}
+
+func TestCmdListCheckKeepsManifest(t *testing.T) {
+	for _, check := range []bool{false, true} {
+		pkg := setupManifest(t)
+
+		defer func(v bool) { *fCheck = v }(*fCheck)
+		*fCheck = check
+
+		// the manifest has an entry for a directive that no longer exists
+		old := &manifest{
+			Dir: pkg.Dir,
+			Directives: []*manifestEntry{
+				{File: "p.go", Args: []string{"gen"}, Outputs: []string{"gen_p_gen.go"}},
+				{File: "p.go", Args: []string{"gen", "-old"}, Outputs: []string{"old.txt"}},
+			},
+		}
+
+		if err := old.save(); err != nil {
+			t.Fatal(err)
+		}
+
+		cmdList([]string{pkg.ImportPath}, true)
+
+		want := 1
+		if check {
+			want = 2
+		}
+
+		if got := len(loadManifest(pkg.Dir).Directives); got != want {
+			t.Errorf("with -check=%v, manifest has %v entries after cmdList; want %v", check, got, want)
+		}
+	}
+}
+
+func TestManifestOrphans(t *testing.T) {
+	tests := []struct {
+		name string
+
+		// hash is the hash recorded for the orphan; "" for the hash of the
+		// contents as written
+		hash    string
+		content string
+		removed bool
+	}{
+		{
+			name:    "as written",
+			content: "written\n",
+			removed: true,
+		},
+		{
+			name:    "edited",
+			content: "edited\n",
+			removed: false,
+		},
+		{
+			name:    "hash unknown",
+			hash:    "-",
+			content: "written\n",
+			removed: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pkg := setupManifest(t)
+
+			f := filepath.Join(pkg.Dir, "helper.go")
+
+			if err := ioutil.WriteFile(f, []byte("written\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			h, err := hashFile(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			hashes := map[string]string{"helper.go": h}
+
+			switch tt.hash {
+			case "":
+			case "-":
+				hashes = nil
+			default:
+				hashes["helper.go"] = tt.hash
+			}
+
+			old := &manifest{
+				Dir: pkg.Dir,
+				Directives: []*manifestEntry{
+					{File: "p.go", Args: []string{"gen", "-old"}, Outputs: []string{"helper.go"}, Hashes: hashes},
+				},
+			}
+
+			if err := old.save(); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := ioutil.WriteFile(f, []byte(tt.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			m := loadManifest(pkg.Dir)
+
+			var want []string
+			if tt.removed {
+				want = []string{f}
+			}
+
+			if got := m.orphans(nil); !reflect.DeepEqual(got, want) {
+				t.Errorf("orphans() = %v; want %v", got, want)
+			}
+
+			if n := len(m.Directives); n != 0 {
+				t.Errorf("manifest has %v entries; want 0", n)
+			}
+		})
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Phase is a stage of the generation pipeline. The phases of a config run in
+// the order declared, and gg repeats the pipeline until no phase changes any
+// package whose changes have not been seen by every phase (see generate)
+type Phase struct {
+	Name string
+
+	// Generators lists the import paths (or command names) of generators
+	// that run in the phase, as Typed and Untyped do for the default phases
+	Generators []string `json:",omitempty"`
+
+	// Compiled indicates that the generators in the phase require the
+	// compiled dependencies of the packages in which they run. Packages are
+	// compiled (see goInstall) before the phase runs, which it then does
+	// only for those packages that compile. Otherwise the phase is run
+	// repeatedly until it changes nothing further before the next starts
+	Compiled bool `json:",omitempty"`
+}
+
+// defaultPhases are the phases of a config that declares none: untyped
+// generators work from source alone, whereas typed generators require
+// compiled dependencies
+var defaultPhases = []*Phase{
+	{Name: "untyped"},
+	{Name: "typed", Compiled: true},
+}
+
+// phaseInfo returns the phase named name, or nil if c has no such phase
+func (c *Config) phaseInfo(name string) *Phase {
+	for _, ph := range c.phases {
+		if ph.Name == name {
+			return ph
+		}
+	}
+
+	return nil
+}
+
+// compiled returns whether the phase named name requires compiled
+// dependencies
+func (c *Config) compiled(name string) bool {
+	ph := c.phaseInfo(name)
+
+	return ph != nil && ph.Compiled
+}
+
+// initOrder validates the After constraints of c's generators and computes
+// their transitive closure
+func (c *Config) initOrder() {
+	pos := make(map[string]int, len(c.phases))
+	for i, ph := range c.phases {
+		pos[ph.Name] = i
+	}
+
+	c.after = make(map[string]map[string]struct{})
+
+	for _, g := range c.entries {
+		for _, a := range g.After {
+			ag, ok := c.gens[a]
+			if !ok {
+				fatalf("%v must run after %v, which is not a configured generator (config: %v)", g.Path, a, c.describe())
+			}
+
+			switch {
+			case pos[ag.Phase] > pos[g.Phase]:
+				fatalf("%v in phase %v cannot run after %v in the later phase %v (config: %v)", g.Path, g.Phase, ag.Path, ag.Phase, c.describe())
+			case ag.Phase == g.Phase && g.Batch && !ag.Batch:
+				fatalf("batch generator %v cannot run after %v, which is not a batch generator, in the same phase (config: %v)", g.Path, ag.Path, c.describe())
+			}
+		}
+	}
+
+	var visit func(cmd string, path []string)
+
+	visit = func(cmd string, path []string) {
+		if _, ok := c.after[cmd]; ok {
+			return
+		}
+
+		for _, p := range path {
+			if p == cmd {
+				fatalf("generators are ordered in a cycle: %v (config: %v)", strings.Join(append(path, cmd), " after "), c.describe())
+			}
+		}
+
+		path = append(path, cmd)
+
+		res := make(map[string]struct{})
+
+		for _, a := range c.gens[cmd].After {
+			visit(a, path)
+
+			res[a] = struct{}{}
+			for t := range c.after[a] {
+				res[t] = struct{}{}
+			}
+		}
+
+		c.after[cmd] = res
+	}
+
+	for _, g := range c.entries {
+		visit(g.cmd(), nil)
+	}
+}
+
+// runsAfter returns whether generator cmd must run after generator other,
+// directly or indirectly, within a package
+func (c *Config) runsAfter(cmd, other string) bool {
+	_, ok := c.after[cmd][other]
+	return ok
+}
+
+// order returns dirs in the order in which they run: that of go generate,
+// except that a directive is deferred until the directives of all the
+// generators it must run after (see Generator.After) have run
+func (c *Config) order(dirs []directive) []directive {
+	idx, _ := stableOrder(len(dirs), func(i, j int) bool {
+		return c.runsAfter(dirs[j].cmd(), dirs[i].cmd())
+	})
+
+	res := make([]directive, len(dirs))
+	for i, v := range idx {
+		res[i] = dirs[v]
+	}
+
+	return res
+}
+
+// stableOrder returns the indices 0 to n-1 ordered such that i precedes j
+// whenever before(i, j), and otherwise in ascending order. If the
+// constraints form a cycle, the indices involved are placed in ascending
+// order and the boolean result is false
+func stableOrder(n int, before func(i, j int) bool) ([]int, bool) {
+	placed := make([]bool, n)
+	res := make([]int, 0, n)
+	ok := true
+
+	ready := func(i int) bool {
+		for j := 0; j < n; j++ {
+			if !placed[j] && j != i && before(j, i) {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	for len(res) < n {
+		next := -1
+
+		for i := 0; i < n && next == -1; i++ {
+			if !placed[i] && ready(i) {
+				next = i
+			}
+		}
+
+		if next == -1 {
+			// every remaining index waits on another
+			ok = false
+
+			for i := 0; next == -1; i++ {
+				if !placed[i] {
+					next = i
+				}
+			}
+		}
+
+		placed[next] = true
+		res = append(res, next)
+	}
+
+	return res, ok
+}
+
+// pipeline returns the phases of the configs in force for pkgs, merged into
+// a single order consistent with the order of each config. Configs must
+// agree on the order of the phases they share and on whether each requires
+// compiled dependencies
+func pipeline(pkgs []string) []*Phase {
+	var phases []*Phase
+
+	byName := make(map[string]*Phase)
+	from := make(map[string]*Config)
+	before := make(map[string]map[string]bool)
+	seen := make(map[*Config]bool)
+
+	for _, p := range pkgs {
+		c := pkgConfig(p)
+
+		if seen[c] {
+			continue
+		}
+
+		seen[c] = true
+
+		for i, ph := range c.phases {
+			if q, ok := byName[ph.Name]; !ok {
+				byName[ph.Name] = ph
+				from[ph.Name] = c
+				phases = append(phases, ph)
+			} else if q.Compiled != ph.Compiled {
+				yes, no := from[ph.Name], c
+				if ph.Compiled {
+					yes, no = no, yes
+				}
+
+				fatalf("phase %v requires compiled dependencies per %v but not per %v", ph.Name, yes.describe(), no.describe())
+			}
+
+			for _, prev := range c.phases[:i] {
+				if before[prev.Name] == nil {
+					before[prev.Name] = make(map[string]bool)
+				}
+
+				before[prev.Name][ph.Name] = true
+			}
+		}
+	}
+
+	idx, ok := stableOrder(len(phases), func(i, j int) bool {
+		return before[phases[i].Name][phases[j].Name]
+	})
+	if !ok {
+		// each directory has its own config, so configs merged from the
+		// same files are reported once
+		set := make(map[string]struct{})
+		for c := range seen {
+			set[fmt.Sprintf("%v (%v)", phaseNames(c.phases), c.describe())] = struct{}{}
+		}
+
+		names := keySlice(set)
+		sort.Strings(names)
+
+		fatalf("configs declare phases in conflicting orders:\n%v", strings.Join(names, "\n"))
+	}
+
+	res := make([]*Phase, len(idx))
+	for i, v := range idx {
+		res[i] = phases[v]
+	}
+
+	return res
+}
+
+// phasePkgs returns the subset of pkgs whose configs have the phase named
+// name
+func phasePkgs(name string, pkgs []string) []string {
+	var res []string
+
+	for _, p := range pkgs {
+		if pkgConfig(p).phaseInfo(name) != nil {
+			res = append(res, p)
+		}
+	}
+
+	return res
+}
+
+// phaseNames returns the names of phases, separated by commas
+func phaseNames(phases []*Phase) string {
+	names := make([]string, len(phases))
+	for i, ph := range phases {
+		names[i] = ph.Name
+	}
+
+	return strings.Join(names, ",")
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestStableOrder(t *testing.T) {
+	tests := []struct {
+		name string
+		n    int
+
+		// before lists pairs i, j such that i must precede j
+		before [][2]int
+
+		want   []int
+		wantOK bool
+	}{
+		{
+			name:   "no constraints",
+			n:      3,
+			want:   []int{0, 1, 2},
+			wantOK: true,
+		},
+		{
+			name:   "one deferred",
+			n:      3,
+			before: [][2]int{{2, 0}},
+			want:   []int{1, 2, 0},
+			wantOK: true,
+		},
+		{
+			name:   "chain",
+			n:      4,
+			before: [][2]int{{3, 2}, {2, 1}, {1, 0}},
+			want:   []int{3, 2, 1, 0},
+			wantOK: true,
+		},
+		{
+			name:   "cycle",
+			n:      3,
+			before: [][2]int{{1, 0}, {0, 1}},
+			want:   []int{2, 0, 1},
+			wantOK: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := stableOrder(tt.n, func(i, j int) bool {
+				for _, b := range tt.before {
+					if b[0] == i && b[1] == j {
+						return true
+					}
+				}
+
+				return false
+			})
+
+			if !reflect.DeepEqual(got, tt.want) || ok != tt.wantOK {
+				t.Errorf("stableOrder() = %v, %v; want %v, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestInitOrder(t *testing.T) {
+	tests := []struct {
+		name string
+		gens string
+
+		// after lists the generators that must run before a, transitively
+		after []string
+		err   string
+	}{
+		{
+			name:  "transitive",
+			gens:  `{"Path": "ex/a", "Phase": "untyped", "After": ["b"]}, {"Path": "ex/b", "Phase": "untyped", "After": ["c"]}, {"Path": "ex/c", "Phase": "untyped"}`,
+			after: []string{"b", "c"},
+		},
+		{
+			name:  "earlier phase",
+			gens:  `{"Path": "ex/a", "Phase": "typed", "After": ["b"]}, {"Path": "ex/b", "Phase": "untyped"}`,
+			after: []string{"b"},
+		},
+		{
+			name: "unknown generator",
+			gens: `{"Path": "ex/a", "Phase": "untyped", "After": ["zz"]}`,
+			err:  "ex/a must run after zz, which is not a configured generator",
+		},
+		{
+			name: "later phase",
+			gens: `{"Path": "ex/a", "Phase": "untyped", "After": ["b"]}, {"Path": "ex/b", "Phase": "typed"}`,
+			err:  "ex/a in phase untyped cannot run after ex/b in the later phase typed",
+		},
+		{
+			name: "cycle",
+			gens: `{"Path": "ex/a", "Phase": "untyped", "After": ["b"]}, {"Path": "ex/b", "Phase": "untyped", "After": ["a"]}`,
+			err:  "generators are ordered in a cycle: a after b after a",
+		},
+		{
+			name: "batch after a generator that is not",
+			gens: `{"Path": "ex/a", "Phase": "untyped", "Batch": true, "After": ["b"]}, {"Path": "ex/b", "Phase": "untyped"}`,
+			err:  "batch generator ex/a cannot run after ex/b, which is not a batch generator, in the same phase",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := setupCache(t)
+			writeFiles(t, dir, map[string]string{
+				ConfigFileName: `{"Root": true, "Generators": [` + tt.gens + `]}`,
+			})
+
+			var c *Config
+
+			err := catch(func() {
+				c = configFor(dir)
+			})
+
+			if tt.err != "" {
+				if err == nil || !strings.Contains(fmt.Sprint(err), tt.err) {
+					t.Fatalf("got error %v; want %q", err, tt.err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var after []string
+			for _, g := range []string{"a", "b", "c"} {
+				if c.runsAfter("a", g) {
+					after = append(after, g)
+				}
+			}
+
+			if !reflect.DeepEqual(after, tt.after) {
+				t.Errorf("a runs after %v; want %v", after, tt.after)
+			}
+		})
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	tests := []struct {
+		name string
+
+		// phases are the Phases of the config of each package
+		phases []string
+
+		want string
+		err  string
+	}{
+		{
+			name:   "defaults",
+			phases: []string{``},
+			want:   "untyped,typed",
+		},
+		{
+			name: "merged",
+			phases: []string{
+				`[{"Name": "gen"}, {"Name": "types", "Compiled": true}]`,
+				`[{"Name": "pre"}, {"Name": "gen"}, {"Name": "post"}]`,
+				`[{"Name": "types", "Compiled": true}, {"Name": "post"}]`,
+			},
+			want: "pre,gen,types,post",
+		},
+		{
+			name: "conflicting orders",
+			phases: []string{
+				`[{"Name": "gen"}, {"Name": "post"}]`,
+				`[{"Name": "post"}, {"Name": "gen"}]`,
+			},
+			err: "configs declare phases in conflicting orders",
+		},
+		{
+			name: "conflicting compilation",
+			phases: []string{
+				`[{"Name": "gen"}]`,
+				`[{"Name": "gen", "Compiled": true}]`,
+			},
+			err: "phase gen requires compiled dependencies",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := setupCache(t)
+
+			var pkgs []string
+
+			for i, ph := range tt.phases {
+				cfg := `{"Root": true}`
+				if ph != "" {
+					cfg = `{"Root": true, "Phases": ` + ph + `}`
+				}
+
+				name := fmt.Sprintf("p%v", i)
+
+				writeFiles(t, dir, map[string]string{name + "/" + ConfigFileName: cfg})
+
+				pkgInfo["ex/"+name] = &Package{ImportPath: "ex/" + name, Dir: filepath.Join(dir, name)}
+				pkgs = append(pkgs, "ex/"+name)
+			}
+
+			var got []*Phase
+
+			err := catch(func() {
+				got = pipeline(pkgs)
+			})
+
+			if tt.err != "" {
+				if err == nil || !strings.Contains(fmt.Sprint(err), tt.err) {
+					t.Fatalf("got error %v; want %q", err, tt.err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if names := phaseNames(got); names != tt.want {
+				t.Errorf("pipeline() = %v; want %v", names, tt.want)
+			}
+		})
+	}
+}
@@ -1,32 +1,166 @@
 package main
 
 import (
+	"bytes"
 	"crypto/sha1"
+	"encoding/json"
 	"fmt"
-	"go/build"
 	"io"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 var (
 	pkgInfo = map[string]*Package{}
 )
 
+// Package is the subset of the output of go list -json that gg uses
 type Package struct {
-	*build.Package
+	ImportPath string
+	Dir        string
+	Name       string
+	Standard   bool
+
+	GoFiles      []string
+	CgoFiles     []string
+	CFiles       []string
+	CXXFiles     []string
+	MFiles       []string
+	HFiles       []string
+	SFiles       []string
+	SwigFiles    []string
+	SwigCXXFiles []string
+	SysoFiles    []string
+	TestGoFiles  []string
+	XTestGoFiles []string
+
+	Imports      []string
+	TestImports  []string
+	XTestImports []string
+	Deps         []string
+
+	Error      *listError
+	DepsErrors []*listError
 
 	pkgHash string
 }
 
+type listError struct {
+	Err string
+}
+
+// goFiles returns the Go files in the package that go generate would scan
+// for directives: GoFiles + CgoFiles + TestGoFiles + XTestGoFiles per go list
+func (p *Package) goFiles() []string {
+	var res []string
+
+	res = append(res, p.GoFiles...)
+	res = append(res, p.CgoFiles...)
+	res = append(res, p.TestGoFiles...)
+	res = append(res, p.XTestGoFiles...)
+
+	return res
+}
+
+// files returns all the files in the package that contribute to its hash
+// (see computePkgHash)
+func (p *Package) files() []string {
+	var res []string
+
+	res = append(res, p.GoFiles...)
+	res = append(res, p.CgoFiles...)
+	res = append(res, p.CFiles...)
+	res = append(res, p.CXXFiles...)
+	res = append(res, p.MFiles...)
+	res = append(res, p.HFiles...)
+	res = append(res, p.SFiles...)
+	res = append(res, p.SwigFiles...)
+	res = append(res, p.SwigCXXFiles...)
+	res = append(res, p.SysoFiles...)
+	res = append(res, p.TestGoFiles...)
+	res = append(res, p.XTestGoFiles...)
+
+	return res
+}
+
+// testImports returns the imports of the package's test files
+func (p *Package) testImports() []string {
+	var res []string
+
+	res = append(res, p.TestImports...)
+	res = append(res, p.XTestImports...)
+
+	return res
+}
+
+// goList runs go list -e -json with the supplied arguments (flags and then
+// package patterns) and returns the resulting packages. go list is module
+// aware, and so patterns like ./... are resolved relative to the main module
+// when in module mode
+func goList(args ...string) []*Package {
+	return goListDir("", args...)
+}
+
+// goListDir is like goList but runs go list in dir
+func goListDir(dir string, args ...string) []*Package {
+	args = append([]string{"list", "-e", "-json"}, args...)
+
+	cmd := exec.Command("go", args...)
+	cmd.Dir = dir
+	stderr := new(bytes.Buffer)
+	cmd.Stderr = stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		fatalf("go list: %v\n%s", err, stderr.Bytes())
+	}
+
+	// warnings such as "matched no packages"
+	if stderr.Len() > 0 {
+		vvlogf("%s", stderr.Bytes())
+	}
+
+	var res []*Package
+
+	dec := json.NewDecoder(bytes.NewReader(out))
+
+	for {
+		var p Package
+
+		if err := dec.Decode(&p); err == io.EOF {
+			break
+		} else if err != nil {
+			fatalf("could not decode go list output: %v", err)
+		}
+
+		res = append(res, &p)
+	}
+
+	return res
+}
+
+// readPkgs loads the packages matched by the patterns in pkgs into pkgInfo. If
+// ignore is true, packages excluded via -X are skipped
 func readPkgs(pkgs []string, ignore bool) {
 
 All:
-	for _, pn := range pkgs {
-		p, err := build.Import(pn, wd, 0)
-		if err != nil {
-			fatalf("could not load package %v: %v", pn, err)
+	for _, p := range goList(pkgs...) {
+		if p.Dir == "" {
+			msg := "not found"
+			if p.Error != nil {
+				msg = p.Error.Err
+			}
+
+			fatalf("could not load package %v: %v", p.ImportPath, msg)
+		}
+
+		if p.Error != nil {
+			// the package might well be fixed by generation; the compile step
+			// will report this if not
+			vvlogf("error loading package %v: %v", p.ImportPath, p.Error.Err)
 		}
 
 		if ignore {
@@ -49,7 +183,7 @@ All:
 
 		}
 
-		pkgInfo[p.ImportPath] = &Package{Package: p}
+		pkgInfo[p.ImportPath] = p
 	}
 }
 
@@ -95,22 +229,13 @@ func deltaHash(snap map[string]string) []string {
 }
 
 func computePkgHash(p *Package) {
+	defer times.since(timeHashing, "packages", time.Now())
+
 	h := sha1.New()
 
 	fmt.Fprintf(h, "pkg %v\n", p.ImportPath)
 
-	hashFiles(h, p.Dir, p.GoFiles)
-	hashFiles(h, p.Dir, p.CgoFiles)
-	hashFiles(h, p.Dir, p.CFiles)
-	hashFiles(h, p.Dir, p.CXXFiles)
-	hashFiles(h, p.Dir, p.MFiles)
-	hashFiles(h, p.Dir, p.HFiles)
-	hashFiles(h, p.Dir, p.SFiles)
-	hashFiles(h, p.Dir, p.SwigFiles)
-	hashFiles(h, p.Dir, p.SwigCXXFiles)
-	hashFiles(h, p.Dir, p.SysoFiles)
-	hashFiles(h, p.Dir, p.TestGoFiles)
-	hashFiles(h, p.Dir, p.XTestGoFiles)
+	hashFiles(h, p.Dir, p.files())
 
 	hash := fmt.Sprintf("%x", h.Sum(nil))
 	p.pkgHash = hash
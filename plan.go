@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// printPlan prints what generate(dirPkgs, stale) would do: the packages that
+// are stale, including those without directives, and the directives that
+// would run in the first iteration of each phase of the first round. Files
+// that would be removed by cmdList have already been printed by the time
+// printPlan is called. Later iterations depend on the output of generators
+// and so cannot be predicted
+func printPlan(dirPkgs, stale []string) {
+	isStale := make(map[string]struct{}, len(stale))
+	for _, p := range stale {
+		isStale[p] = struct{}{}
+	}
+
+	isDir := make(map[string]struct{}, len(dirPkgs))
+	for _, p := range dirPkgs {
+		isDir[p] = struct{}{}
+	}
+
+	var plain []string
+	for _, p := range stale {
+		if _, ok := isDir[p]; !ok {
+			plain = append(plain, p)
+		}
+	}
+
+	sort.Strings(plain)
+
+	for _, p := range plain {
+		fmt.Printf("stale %v (no directives)\n", p)
+	}
+
+	// phases that require compiled dependencies run for the dependents of
+	// stale packages, the remainder only for stale packages
+	compiled := topoSort(dependents(stale, dirPkgs))
+
+	var uncompiled []string
+
+	for _, p := range compiled {
+		if _, ok := isStale[p]; ok {
+			fmt.Printf("stale %v\n", p)
+			uncompiled = append(uncompiled, p)
+			continue
+		}
+
+		var deps []string
+		for d := range pkgDeps[p] {
+			if _, ok := isStale[d]; ok {
+				deps = append(deps, d)
+			}
+		}
+
+		sort.Strings(deps)
+
+		fmt.Printf("stale %v (depends on stale %v)\n", p, strings.Join(deps, ", "))
+	}
+
+	sort.Strings(uncompiled)
+
+	printDirs := func(phase string, pkgs []string) {
+		for _, p := range pkgs {
+			dirs, err := pkgDirectives(p)
+			if err != nil {
+				fatalf("could not read directives in %v: %v", p, err)
+			}
+
+			c := pkgConfig(p)
+			cmds := c.cmds(phase)
+
+			for _, d := range c.order(dirs) {
+				if _, ok := cmds[d.cmd()]; ok {
+					fmt.Printf("%v %v\n", phase, d)
+				}
+			}
+		}
+	}
+
+	for _, ph := range pipeline(dirPkgs) {
+		if ph.Compiled {
+			printDirs(ph.Name, compiled)
+		} else {
+			printDirs(ph.Name, uncompiled)
+		}
+	}
+}
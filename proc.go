@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// killGrace is how long a generator being stopped has to exit after being
+// asked to terminate before its process group is killed
+const killGrace = 2 * time.Second
+
+var (
+	// baseCtx is cancelled when gg is interrupted (see handleInterrupts)
+	baseCtx = context.Background()
+
+	// runCtx is cancelled when the current run is to stop, either because
+	// gg is interrupted or because the run has exceeded -timeout
+	runCtx = context.Background()
+
+	interruptOnce sync.Once
+)
+
+// killedError is the error from a generator that gg stopped, killing its
+// process group, because it exceeded its timeout or the run was stopped
+type killedError struct {
+	reason string
+	err    error
+}
+
+func (e *killedError) Error() string {
+	return e.reason
+}
+
+func (e *killedError) Unwrap() error {
+	return e.err
+}
+
+// handleInterrupts arranges for an interrupt or termination signal to stop
+// the run rather than gg itself, so that gg can stop its generators cleanly
+// and leave the tree in a known state. Generators run in their own process
+// groups (see runGenerator) and so do not themselves see an interrupt from
+// the terminal. Only the first signal is handled: a second terminates gg
+func handleInterrupts() {
+	interruptOnce.Do(func() {
+		ctx, cancel := context.WithCancel(context.Background())
+
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+
+		go func() {
+			<-sigs
+			signal.Stop(sigs)
+			cancel()
+		}()
+
+		baseCtx = ctx
+		runCtx = ctx
+	})
+}
+
+// startRun starts a run, limited to -timeout if that is set, returning a
+// function that ends it
+func startRun() func() {
+	if *fTimeout <= 0 {
+		runCtx = baseCtx
+		return func() {}
+	}
+
+	ctx, cancel := context.WithTimeout(baseCtx, *fTimeout)
+	runCtx = ctx
+
+	return func() {
+		cancel()
+		runCtx = baseCtx
+	}
+}
+
+// stopped returns an error describing why the current run has been stopped,
+// or nil if it has not
+func stopped() error {
+	switch {
+	case baseCtx.Err() != nil:
+		return fmt.Errorf("interrupted")
+	case runCtx.Err() != nil:
+		return fmt.Errorf("run exceeded -timeout of %v", *fTimeout)
+	}
+
+	return nil
+}
+
+// runGenerator runs args, the command line for generator g, in dir with env
+// added to the environment, writing its combined output to out. If g has
+// been built by gg (see Generator.bin), that build is run and its directory
+// is first on the command's PATH. The command runs in its own process group,
+// which is stopped, asked first to terminate and then killed, if the command
+// exceeds g's timeout or the run is stopped; the error is then a
+// *killedError
+func runGenerator(g *Generator, dir string, args []string, env []string, out io.Writer) error {
+	if err := stopped(); err != nil {
+		return err
+	}
+
+	name := args[0]
+
+	var path []string
+
+	if b := g.bin(); b != "" && !strings.ContainsRune(name, filepath.Separator) {
+		name = b
+		path = []string{"PATH=" + filepath.Dir(b) + string(os.PathListSeparator) + os.Getenv("PATH")}
+	}
+
+	cmd := exec.Command(name, args[1:]...)
+	cmd.Dir = dir
+	cmd.Env = append(append(os.Environ(), path...), env...)
+	cmd.Stdout = out
+	cmd.Stderr = out
+
+	setProcGroup(cmd)
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	var timeout <-chan time.Time
+
+	if g.timeout > 0 {
+		t := time.NewTimer(g.timeout)
+		defer t.Stop()
+
+		timeout = t.C
+	}
+
+	var reason string
+
+	select {
+	case err := <-done:
+		return err
+	case <-timeout:
+		reason = fmt.Sprintf("timed out after %v", g.timeout)
+	case <-runCtx.Done():
+		reason = stopped().Error()
+	}
+
+	return &killedError{reason: reason, err: stopProcGroup(cmd, done)}
+}
+
+// stopProcGroup stops the process group of cmd, which has been started with
+// setProcGroup, asking it to terminate and then, if cmd has not exited
+// within killGrace, killing it. done receives the result of cmd.Wait
+func stopProcGroup(cmd *exec.Cmd, done chan error) error {
+	signalProcGroup(cmd, false)
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(killGrace):
+	}
+
+	signalProcGroup(cmd, true)
+
+	// Wait returns once the output of the group has been copied, which it
+	// will have been unless a process has escaped the group
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(killGrace):
+		return fmt.Errorf("process %v did not exit after being killed", cmd.Process.Pid)
+	}
+}
+
+// undo restores the directories of s, returning a description of the
+// changes undone, or of the failure to undo them, for use in errors
+func undo(s *snapshot) string {
+	cs, err := s.restore()
+	if err != nil {
+		return fmt.Sprintf("; could not undo changes: %v", err)
+	}
+
+	if len(cs) == 0 {
+		return ""
+	}
+
+	var msgs []string
+	for _, c := range cs {
+		msgs = append(msgs, c.kind+" "+relPath(c.path))
+	}
+
+	return fmt.Sprintf("; undid changes: %v", strings.Join(msgs, ", "))
+}
+
+// leftChanges describes, for use in errors, the files in the directories of
+// before, keyed by directory, that differ from the hashes (see dirHashes) in
+// before. It is used where a stopped generator was not snapshotted, and so
+// its changes cannot be undone
+func leftChanges(before map[string]map[string]string) string {
+	var dirs []string
+	for d := range before {
+		dirs = append(dirs, d)
+	}
+
+	sort.Strings(dirs)
+
+	var msgs []string
+
+	for _, d := range dirs {
+		after, err := dirHashes(d)
+		if err != nil {
+			return fmt.Sprintf("; could not determine changes left: %v", err)
+		}
+
+		var names []string
+		for n := range after {
+			names = append(names, n)
+		}
+		for n := range before[d] {
+			if _, ok := after[n]; !ok {
+				names = append(names, n)
+			}
+		}
+
+		sort.Strings(names)
+
+		for _, n := range names {
+			bh, existed := before[d][n]
+			ah, exists := after[n]
+
+			var kind string
+
+			switch {
+			case !existed:
+				kind = "created"
+			case !exists:
+				kind = "deleted"
+			case bh != ah:
+				kind = "modified"
+			default:
+				continue
+			}
+
+			msgs = append(msgs, kind+" "+relPath(filepath.Join(d, n)))
+		}
+	}
+
+	if len(msgs) == 0 {
+		return ""
+	}
+
+	return fmt.Sprintf("; left changes: %v", strings.Join(msgs, ", "))
+}
@@ -0,0 +1,18 @@
+//go:build !unix
+
+package main
+
+import (
+	"os/exec"
+)
+
+// setProcGroup does nothing: there are no process groups here, so only the
+// generator itself can be stopped
+func setProcGroup(cmd *exec.Cmd) {
+}
+
+// signalProcGroup kills the process of cmd, there being no way to ask it to
+// terminate
+func signalProcGroup(cmd *exec.Cmd, kill bool) {
+	cmd.Process.Kill()
+}
@@ -0,0 +1,25 @@
+//go:build unix
+
+package main
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setProcGroup arranges for cmd to run in a new process group, so that any
+// processes it starts can be stopped along with it
+func setProcGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// signalProcGroup asks the process group of cmd to terminate or, if kill is
+// true, kills it
+func signalProcGroup(cmd *exec.Cmd, kill bool) {
+	sig := syscall.SIGTERM
+	if kill {
+		sig = syscall.SIGKILL
+	}
+
+	syscall.Kill(-cmd.Process.Pid, sig)
+}
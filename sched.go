@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// runPkgs calls f for each of pkgs, with at most *fParallel calls running
+// concurrently. A package is not started until all packages in pkgs that it
+// imports, directly or indirectly, have completed successfully. Imports via
+// tests are not considered: they can form cycles (the external test of a
+// importing a package that imports a), in which no package would ever be
+// ready. Once any call fails no further packages are started; the first
+// error is returned once all running calls have completed. f must not call
+// fatalf (it is not called on the main goroutine)
+func runPkgs(pkgs []string, f func(pkg string) error) error {
+	in := make(map[string]struct{}, len(pkgs))
+	for _, p := range pkgs {
+		in[p] = struct{}{}
+	}
+
+	waiting := make(map[string]int)
+	rdeps := make(map[string][]string)
+
+	for _, p := range pkgs {
+		for _, d := range pkgInfo[p].Deps {
+			if _, ok := in[d]; ok {
+				waiting[p]++
+				rdeps[d] = append(rdeps[d], p)
+			}
+		}
+	}
+
+	var ready []string
+
+	for _, p := range topoSort(pkgs) {
+		if waiting[p] == 0 {
+			ready = append(ready, p)
+		}
+	}
+
+	type result struct {
+		pkg string
+		err error
+	}
+
+	done := make(chan result)
+	running := 0
+	started := 0
+
+	var firstErr error
+
+	for {
+		for firstErr == nil && running < *fParallel && len(ready) > 0 {
+			p := ready[0]
+			ready = ready[1:]
+			running++
+			started++
+
+			go func() {
+				done <- result{pkg: p, err: f(p)}
+			}()
+		}
+
+		if running == 0 {
+			break
+		}
+
+		r := <-done
+		running--
+
+		if r.err != nil {
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			continue
+		}
+
+		for _, p := range rdeps[r.pkg] {
+			waiting[p]--
+			if waiting[p] == 0 {
+				ready = append(ready, p)
+			}
+		}
+	}
+
+	if firstErr == nil && started < len(in) {
+		// cannot happen given that imports do not form cycles, but we must
+		// not report success for packages that never ran
+		var missed []string
+		for p := range in {
+			if waiting[p] > 0 {
+				missed = append(missed, p)
+			}
+		}
+
+		sort.Strings(missed)
+
+		return fmt.Errorf("packages never became ready to run: %v", strings.Join(missed, " "))
+	}
+
+	return firstErr
+}
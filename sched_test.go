@@ -0,0 +1,91 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRunPkgs(t *testing.T) {
+	tests := []struct {
+		name string
+
+		// deps gives the Deps of each package
+		deps map[string][]string
+
+		// testDeps gives the packages on which each package depends only
+		// via its tests
+		testDeps map[string][]string
+
+		want []string
+		err  string
+	}{
+		{
+			name: "chain",
+			deps: map[string][]string{"ex/c": {"ex/b", "ex/a"}, "ex/b": {"ex/a"}, "ex/a": nil},
+			want: []string{"ex/a", "ex/b", "ex/c"},
+		},
+		{
+			name:     "cycle via an external test",
+			deps:     map[string][]string{"ex/a": nil, "ex/a/testutil": {"ex/a"}},
+			testDeps: map[string][]string{"ex/a": {"ex/a/testutil"}},
+			want:     []string{"ex/a", "ex/a/testutil"},
+		},
+		{
+			name: "never ready",
+			deps: map[string][]string{"ex/a": {"ex/b"}, "ex/b": {"ex/a"}},
+			err:  "packages never became ready to run: ex/a ex/b",
+		},
+	}
+
+	defer func(v int) { *fParallel = v }(*fParallel)
+	*fParallel = 1
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pkgInfo = make(map[string]*Package)
+			pkgDeps = make(map[string]map[string]struct{})
+
+			var pkgs []string
+
+			for p, ds := range tt.deps {
+				pkgInfo[p] = &Package{ImportPath: p, Deps: ds}
+				pkgDeps[p] = make(map[string]struct{})
+
+				for _, d := range append(ds, tt.testDeps[p]...) {
+					pkgDeps[p][d] = struct{}{}
+				}
+
+				pkgs = append(pkgs, p)
+			}
+
+			var mu sync.Mutex
+			var got []string
+
+			err := runPkgs(pkgs, func(p string) error {
+				mu.Lock()
+				got = append(got, p)
+				mu.Unlock()
+
+				return nil
+			})
+
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v; want %q", err, tt.err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ran %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"myitcv.io/gogenerate"
+)
+
+// fileState is the state of a file at the point a snapshot was taken
+type fileState struct {
+	mode    os.FileMode
+	content []byte
+}
+
+// snapshot records the regular files in a set of directories (not
+// recursively), keyed by absolute path
+type snapshot struct {
+	dirs  []string
+	files map[string]fileState
+}
+
+// fileChange describes how a file differs from a snapshot
+type fileChange struct {
+	path string
+	kind string // one of created, modified or deleted
+}
+
+func pkgDirs(pkgs []string) []string {
+	seen := make(map[string]struct{})
+
+	var res []string
+
+	for _, p := range pkgs {
+		d := pkgInfo[p].Dir
+
+		if _, ok := seen[d]; !ok {
+			seen[d] = struct{}{}
+			res = append(res, d)
+		}
+	}
+
+	sort.Strings(res)
+
+	return res
+}
+
+// takeSnapshot records the regular files in dirs. It does not call fatalf,
+// and so can be used from any goroutine
+func takeSnapshot(dirs []string) (*snapshot, error) {
+	s := &snapshot{
+		dirs:  dirs,
+		files: make(map[string]fileState),
+	}
+
+	for _, d := range dirs {
+		fis, err := dirFiles(d)
+		if err != nil {
+			return nil, err
+		}
+
+		for fn, fi := range fis {
+			b, err := ioutil.ReadFile(fn)
+			if err != nil {
+				return nil, fmt.Errorf("could not read %v: %v", fn, err)
+			}
+
+			s.files[fn] = fileState{mode: fi.Mode(), content: b}
+		}
+	}
+
+	return s, nil
+}
+
+// readDirFiles returns the regular files in dir keyed by absolute path
+func readDirFiles(dir string) map[string]os.FileInfo {
+	res, err := dirFiles(dir)
+	if err != nil {
+		fatalf("%v", err)
+	}
+
+	return res
+}
+
+// dirFiles is like readDirFiles but returns an error rather than calling
+// fatalf
+func dirFiles(dir string) (map[string]os.FileInfo, error) {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("could not read directory %v: %v", dir, err)
+	}
+
+	res := make(map[string]os.FileInfo, len(fis))
+
+	for _, fi := range fis {
+		if fi.Mode().IsRegular() {
+			res[filepath.Join(dir, fi.Name())] = fi
+		}
+	}
+
+	return res, nil
+}
+
+// changes returns the files that have been created, modified or deleted since
+// the snapshot was taken, ordered by path
+func (s *snapshot) changes() ([]fileChange, error) {
+	var res []fileChange
+
+	seen := make(map[string]struct{})
+
+	for _, d := range s.dirs {
+		fis, err := dirFiles(d)
+		if err != nil {
+			return nil, err
+		}
+
+		for fn := range fis {
+			seen[fn] = struct{}{}
+
+			prev, ok := s.files[fn]
+			if !ok {
+				res = append(res, fileChange{path: fn, kind: "created"})
+				continue
+			}
+
+			b, err := ioutil.ReadFile(fn)
+			if err != nil {
+				return nil, fmt.Errorf("could not read %v: %v", fn, err)
+			}
+
+			if !bytes.Equal(b, prev.content) {
+				res = append(res, fileChange{path: fn, kind: "modified"})
+			}
+		}
+	}
+
+	for fn := range s.files {
+		if _, ok := seen[fn]; !ok {
+			res = append(res, fileChange{path: fn, kind: "deleted"})
+		}
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].path < res[j].path
+	})
+
+	return res, nil
+}
+
+// restore returns the directories in the snapshot to the state they were in
+// when the snapshot was taken, returning the changes it undid
+func (s *snapshot) restore() ([]fileChange, error) {
+	cs, err := s.changes()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, c := range cs {
+		var err error
+
+		if c.kind == "created" {
+			err = os.Remove(c.path)
+		} else {
+			prev := s.files[c.path]
+			err = ioutil.WriteFile(c.path, prev.content, prev.mode)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("could not restore %v: %v", c.path, err)
+		}
+	}
+
+	return cs, nil
+}
+
+// reportCheck reports the changes found by -check and exits with a non-zero
+// exit code if there are any. Each change is attributed to the directive
+// that owns the file (see manifest) as of the end of the run or, failing
+// that, as of the start, and otherwise to the generator named by the file
+func reportCheck(cs []fileChange) {
+	if len(cs) == 0 {
+		return
+	}
+
+	for _, c := range cs {
+		msg := fmt.Sprintf("%v %v", c.kind, relPath(c.path))
+
+		if d, ok := checkOwners[c.path]; ok {
+			msg += fmt.Sprintf(" (directive %v)", d)
+		} else if e := loadManifest(filepath.Dir(c.path)).owner(filepath.Base(c.path)); e != nil {
+			msg += fmt.Sprintf(" (directive in %v: %v)", relPath(filepath.Join(filepath.Dir(c.path), e.File)), strings.Join(e.Args, " "))
+		} else if cmd, ok := gogenerate.FileIsGenerated(c.path); ok {
+			msg += fmt.Sprintf(" (generator %v)", cmd)
+		}
+
+		log.Print(msg)
+	}
+
+	log.Fatalf("generated files are out of date")
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// timing categories. The categories overlap: the time for a package includes
+// that of the generators it runs, which in turn includes the hashing of its
+// directory for the directive cache, and so on
+const (
+	timeGenerator = "generator"
+	timePackage   = "package"
+	timePhase     = "phase"
+	timeIteration = "iteration"
+	timeInstall   = "install"
+	timeHashing   = "hashing"
+)
+
+// timeCategories is the order in which categories are reported. Within the
+// generator and package categories entries are ordered slowest first; the
+// remainder are reported in the order in which they were first recorded
+var timeCategories = []string{
+	timeGenerator,
+	timePackage,
+	timePhase,
+	timeIteration,
+	timeInstall,
+	timeHashing,
+}
+
+type timing struct {
+	name  string
+	count int
+	total time.Duration
+}
+
+// timings accumulates the wall time spent in the various parts of a run for
+// the report requested by -timings. It is safe for concurrent use
+type timings struct {
+	mu   sync.Mutex
+	cats map[string][]*timing
+}
+
+var times = &timings{}
+
+// add records d against name within category cat
+func (t *timings) add(cat, name string, d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.cats == nil {
+		t.cats = make(map[string][]*timing)
+	}
+
+	for _, e := range t.cats[cat] {
+		if e.name == name {
+			e.count++
+			e.total += d
+			return
+		}
+	}
+
+	t.cats[cat] = append(t.cats[cat], &timing{name: name, count: 1, total: d})
+}
+
+// since records the time since start against name within category cat; it
+// is intended to be deferred
+func (t *timings) since(cat, name string, start time.Time) {
+	t.add(cat, name, time.Since(start))
+}
+
+// write writes the timings recorded so far as a table to w
+func (t *timings) write(w io.Writer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+
+	fmt.Fprintf(tw, "CATEGORY\tNAME\tCOUNT\tTIME\n")
+
+	for _, c := range timeCategories {
+		es := append([]*timing(nil), t.cats[c]...)
+
+		if c == timeGenerator || c == timePackage {
+			sort.SliceStable(es, func(i, j int) bool {
+				return es[i].total > es[j].total
+			})
+		}
+
+		for _, e := range es {
+			fmt.Fprintf(tw, "%v\t%v\t%v\t%v\n", c, e.name, e.count, e.total.Round(time.Millisecond))
+		}
+	}
+
+	tw.Flush()
+}
+
+// reportTimings writes the timings recorded so far per -timings, to stderr
+// or the named file, and then resets them
+func reportTimings() {
+	if !fTimings.set {
+		return
+	}
+
+	if fTimings.file == "" {
+		times.write(os.Stderr)
+	} else {
+		f, err := os.Create(fTimings.file)
+		if err != nil {
+			fatalf("could not create timings file: %v", err)
+		}
+
+		times.write(f)
+
+		if err := f.Close(); err != nil {
+			fatalf("could not write timings file: %v", err)
+		}
+	}
+
+	times.mu.Lock()
+	times.cats = nil
+	times.mu.Unlock()
+}
+
+// timingsFlag is the value of -timings, which can be used either as a
+// boolean flag or to name a file
+type timingsFlag struct {
+	set  bool
+	file string
+}
+
+func (f *timingsFlag) IsBoolFlag() bool {
+	return true
+}
+
+func (f *timingsFlag) Set(value string) error {
+	switch value {
+	case "true":
+		f.set, f.file = true, ""
+	case "false":
+		f.set, f.file = false, ""
+	default:
+		f.set, f.file = true, value
+	}
+
+	return nil
+}
+
+func (f *timingsFlag) String() string {
+	if f.file != "" {
+		return f.file
+	}
+
+	return fmt.Sprint(f.set)
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"myitcv.io/gogenerate"
+)
+
+const watchInterval = 500 * time.Millisecond
+
+// watcher is the state of watch between polls
+type watcher struct {
+	args []string
+
+	// all are the packages matched by args as of the last listing, which
+	// is kept along with pkgInfo until the package directories change
+	all []string
+
+	// hashes are the package hashes (see computePkgHash) against which
+	// changes are detected; a package without a hash is changed
+	hashes map[string]string
+
+	// stamps are the states of the package directories (see dirStamp) as of
+	// the last listing
+	stamps map[string]string
+
+	// pre are the source hashes (see srcHash) of the packages from before
+	// the current run
+	pre map[string]string
+}
+
+// watch never returns, although it fails (see fatalf) if gg is interrupted.
+// It polls the directories of the packages matched by args, listing and
+// hashing the packages again only when a directory has changed, and runs the
+// generation loop for those packages whose hash has changed. After a run,
+// the hashes of the packages are recorded so that the files written by the
+// generators do not themselves trigger a further run, except for those
+// packages in which a file that is not generated changed during the run:
+// such edits were made while gg was running and so still need a run. Errors
+// are logged rather than being fatal
+func watch(args []string) {
+	w := &watcher{
+		args:   args,
+		hashes: make(map[string]string),
+	}
+
+	first := true
+
+	for {
+		err := catch(func() {
+			w.poll(first)
+		})
+		if err != nil {
+			log.Println(err)
+		}
+
+		if baseCtx.Err() != nil {
+			fatalf("interrupted")
+		}
+
+		first = false
+
+		if w.pre != nil {
+			// whatever happened, the current state of the packages is the
+			// baseline for the next poll; we don't want to retry a failed
+			// generator until something changes
+			err := catch(func() {
+				w.rebase()
+			})
+			if err != nil {
+				log.Println(err)
+			}
+		}
+
+		select {
+		case <-time.After(watchInterval):
+		case <-baseCtx.Done():
+			fatalf("interrupted")
+		}
+	}
+}
+
+// poll performs a single poll. If generation is attempted, w.pre is set to
+// the source hashes (see srcHash) of the packages from before the run
+func (w *watcher) poll(first bool) {
+	if w.all != nil && !w.dirsChanged() {
+		return
+	}
+
+	w.list()
+
+	pre := srcHashes(w.all)
+
+	var changed []string
+
+	for _, p := range w.all {
+		computePkgHash(pkgInfo[p])
+
+		if h, ok := w.hashes[p]; !ok || h != pkgInfo[p].pkgHash {
+			changed = append(changed, p)
+		}
+	}
+
+	if len(changed) == 0 {
+		return
+	}
+
+	w.pre = pre
+
+	// the directories might change as soon as we start (cmdList removes
+	// orphans), so from here on we list again on the next poll regardless
+	all := w.all
+	w.all = nil
+
+	dirPkgs := cmdList(all, true)
+
+	buildGenerators(!*fNoBuild, dirPkgs)
+
+	loadDeps()
+
+	if first && !*fForce {
+		changed = cacheStale(all)
+	}
+
+	if len(changed) == 0 {
+		return
+	}
+
+	vvlogf("changed: %v", changed)
+
+	defer startRun()()
+
+	generate(dirPkgs, changed)
+
+	reportTimings()
+}
+
+// rebase lists the packages again after a run and records their hashes,
+// other than those of packages whose source (see srcHash) differs from w.pre
+func (w *watcher) rebase() {
+	pre := w.pre
+	w.pre = nil
+
+	w.list()
+
+	post := srcHashes(w.all)
+
+	for _, p := range w.all {
+		computePkgHash(pkgInfo[p])
+
+		if pre[p] != post[p] {
+			vvlogf("%v changed during the run", p)
+			delete(w.hashes, p)
+
+			// the directory is unchanged since the listing above, so
+			// ensure the next poll lists again
+			w.all = nil
+			continue
+		}
+
+		w.hashes[p] = pkgInfo[p].pkgHash
+	}
+}
+
+// list loads the packages matched by args, recording the states of their
+// directories before they are read so that any later change is seen
+func (w *watcher) list() {
+	known := w.all
+	w.all = nil
+
+	// stat the directories we know about first, so that a change made
+	// while listing is seen by the next poll
+	stamps := make(map[string]string, len(known))
+	for _, p := range known {
+		stamps[p] = dirStamp(pkgInfo[p].Dir)
+	}
+
+	all := loadPkgs(w.args)
+
+	for _, p := range all {
+		if _, ok := stamps[p]; !ok {
+			stamps[p] = dirStamp(pkgInfo[p].Dir)
+		}
+	}
+
+	w.all = all
+	w.stamps = stamps
+}
+
+// dirsChanged returns whether the directory of any of the packages last
+// listed has changed. Packages in new directories are found only when the
+// packages are next listed, which happens when the directory of a package
+// changes, e.g. because the new directory was created in it
+func (w *watcher) dirsChanged() bool {
+	for _, p := range w.all {
+		if dirStamp(pkgInfo[p].Dir) != w.stamps[p] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// dirStamp returns a summary of the state of dir, its entries and their
+// sizes and modification times, or the empty string if dir cannot be read
+func dirStamp(dir string) string {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return ""
+	}
+
+	h := sha1.New()
+
+	for _, fi := range fis {
+		fmt.Fprintf(h, "%v %v %v %v\n", fi.Name(), fi.Mode(), fi.Size(), fi.ModTime().UnixNano())
+	}
+
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// srcHashes returns the source hashes (see srcHash) of pkgs
+func srcHashes(pkgs []string) map[string]string {
+	res := make(map[string]string, len(pkgs))
+
+	for _, p := range pkgs {
+		res[p] = srcHash(pkgInfo[p])
+	}
+
+	return res
+}
+
+// srcHash returns a hash of the files in p that are not generated: neither
+// owned by a directive (see manifest) nor marked as generated
+func srcHash(p *Package) string {
+	defer times.since(timeHashing, "packages", time.Now())
+
+	owned := make(map[string]struct{})
+
+	for _, e := range loadManifest(p.Dir).Directives {
+		for _, o := range e.Outputs {
+			owned[o] = struct{}{}
+		}
+	}
+
+	var files []string
+
+	for _, f := range p.files() {
+		if _, ok := owned[f]; ok {
+			continue
+		}
+
+		if _, ok := gogenerate.FileIsGenerated(filepath.Join(p.Dir, f)); ok {
+			continue
+		}
+
+		files = append(files, f)
+	}
+
+	sort.Strings(files)
+
+	h := sha1.New()
+	hashFiles(h, p.Dir, files)
+
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// catch calls f, returning the value of any panic (see fatalf)
+func catch(f func()) (err interface{}) {
+	defer func() {
+		err = recover()
+	}()
+
+	f()
+
+	return nil
+}